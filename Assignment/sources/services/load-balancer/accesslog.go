@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how a session ended, the termination field of the access log
+const (
+	// the client (or backend) was the first to close its side and the other one followed
+	TerminationClientClosed  = "client_closed"
+	TerminationBackendClosed = "backend_closed"
+	// the connection of the client (or backend) failed, e.g. a connection reset or a broken pipe
+	TerminationClientError  = "client_error"
+	TerminationBackendError = "backend_error"
+	TerminationIdleTimeout  = "idle_timeout"
+	TerminationMaxLifetime  = "max_lifetime"
+	// closed at the end of the shutdown grace period
+	TerminationShutdown = "shutdown"
+	// no backend could be reached
+	TerminationNoBackend = "no_backend"
+	// the backend of a udp flow went down, the next datagram starts a new flow
+	TerminationBackendDown = "backend_down"
+	// an http request answered by the backend
+	TerminationComplete = "complete"
+)
+
+// AccessLogConfig configures the access log, one json line per tcp connection, udp flow or http request
+type AccessLogConfig struct {
+	// "stdout" or the path of the file
+	Output string
+	// the file is rotated once it is bigger than MaxSize bytes, MaxFiles rotated files are kept (file.1 is the newest)
+	MaxSize  int64
+	MaxFiles int
+}
+
+// AccessLogger writes the access log records, a nil AccessLogger drops them
+type AccessLogger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// accessRecord is one line of the access log
+type accessRecord struct {
+	// start of the connection
+	Time time.Time `json:"time"`
+	// tcp, udp or http
+	Protocol string `json:"protocol"`
+	Client   string `json:"client"`
+	// address the client connected to, tells the listeners apart
+	Frontend  string `json:"frontend"`
+	Backend   string `json:"backend"`
+	Algorithm string `json:"algorithm"`
+	// backends that failed before the one used (or before giving up)
+	Retries     int     `json:"retries"`
+	ConnectMs   float64 `json:"connect_ms"`
+	DurationMs  float64 `json:"duration_ms"`
+	BytesIn     int64   `json:"bytes_in"`
+	BytesOut    int64   `json:"bytes_out"`
+	Termination string  `json:"termination"`
+	// http mode only
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// open the access log, nil when it is disabled
+func createAccessLogger(config *AccessLogConfig) (*AccessLogger, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Output == "stdout" {
+		return &AccessLogger{writer: os.Stdout}, nil
+	}
+	file, err := openRotatingFile(config.Output, config.MaxSize, config.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogger{writer: file}, nil
+}
+
+// write adds a record to the access log, its duration is the time since the start of the record
+func (accessLogger *AccessLogger) write(record *accessRecord) {
+	if accessLogger == nil {
+		return
+	}
+	record.DurationMs = milliseconds(time.Since(record.Time))
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode access log record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	accessLogger.mutex.Lock()
+	defer accessLogger.mutex.Unlock()
+	if _, err := accessLogger.writer.Write(line); err != nil {
+		log.Printf("Failed to write access log: %v", err)
+	}
+}
+
+// Close closes the access log file
+func (accessLogger *AccessLogger) Close() {
+	if accessLogger == nil {
+		return
+	}
+	accessLogger.mutex.Lock()
+	defer accessLogger.mutex.Unlock()
+	if closer, ok := accessLogger.writer.(io.Closer); ok && accessLogger.writer != os.Stdout {
+		closer.Close()
+	}
+}
+
+// milliseconds of a duration with a microsecond precision, as written in the access log
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
+
+// rotatingFile is a file that is renamed to file.1 (file.1 to file.2 and so on) once it grew over maxSize
+// the caller serializes the writes
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// open the file for appending, a file left by a previous run is continued
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rotating := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+// open the file and get its current size
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would make it too big
+func (rotating *rotatingFile) Write(p []byte) (int, error) {
+	if rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxSize {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, drops the oldest and starts a new file
+func (rotating *rotatingFile) rotate() error {
+	rotating.file.Close()
+	for i := rotating.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(rotating.path+"."+strconv.Itoa(i), rotating.path+"."+strconv.Itoa(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to rotate access log: %v", err)
+		}
+	}
+	if rotating.maxFiles > 0 {
+		if err := os.Rename(rotating.path, rotating.path+".1"); err != nil {
+			log.Printf("Failed to rotate access log: %v", err)
+		}
+	} else {
+		os.Remove(rotating.path)
+	}
+	return rotating.open()
+}
+
+// Close closes the file
+func (rotating *rotatingFile) Close() error {
+	return rotating.file.Close()
+}
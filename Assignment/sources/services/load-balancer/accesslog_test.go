@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// the file is rotated before a write that would make it too big and only maxFiles rotated files are kept
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rotating, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rotating.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotating.Close()
+
+	want := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for file, content := range want {
+		got, err := os.ReadFile(file)
+		if err != nil || string(got) != content {
+			t.Errorf("%s holds %q (%v), want %q", filepath.Base(file), got, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("more than 2 rotated files are kept")
+	}
+
+	// a file left by a previous run is continued and counts toward the size
+	rotating, err = openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotating.Write([]byte("fifth\n"))
+	rotating.Close()
+	if got, _ := os.ReadFile(path + ".1"); string(got) != "fourth\n" {
+		t.Errorf("access.log.1 holds %q after a restart, want \"fourth\\n\"", got)
+	}
+
+	// without rotated files the full file is dropped
+	rotating, err = openRotatingFile(filepath.Join(t.TempDir(), "access.log"), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotating.Write([]byte("first\n"))
+	rotating.Write([]byte("second\n"))
+	rotating.Close()
+	if got, _ := os.ReadFile(rotating.path); string(got) != "second\n" {
+		t.Errorf("access.log holds %q, want \"second\\n\"", got)
+	}
+	if _, err := os.Stat(rotating.path + ".1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a rotated file is kept with LB_ACCESS_LOG_MAX_FILES=0")
+	}
+}
+
+func TestSessionTermination(t *testing.T) {
+	tests := []struct {
+		name      string
+		cause     error
+		shutdown  bool
+		doneFirst string
+		want      string
+	}{
+		{name: "client closed", doneFirst: sideClient, want: TerminationClientClosed},
+		{name: "backend closed", doneFirst: sideBackend, want: TerminationBackendClosed},
+		{name: "idle", cause: errIdleTimeout, doneFirst: sideClient, want: TerminationIdleTimeout},
+		{name: "max lifetime", cause: errMaxLifetime, doneFirst: sideBackend, want: TerminationMaxLifetime},
+		{name: "client error", cause: &sessionError{side: sideClient, err: syscall.ECONNRESET}, doneFirst: sideClient, want: TerminationClientError},
+		{name: "backend error", cause: &sessionError{side: sideBackend, err: syscall.ECONNRESET}, doneFirst: sideClient, want: TerminationBackendError},
+		{name: "shutdown", shutdown: true, doneFirst: sideBackend, want: TerminationShutdown},
+	}
+	for _, test := range tests {
+		forceClose, cancel := context.WithCancel(context.Background())
+		session, endSession := startSession(forceClose, 0)
+		if test.shutdown {
+			cancel()
+		}
+		if test.cause != nil {
+			endSession(test.cause)
+		}
+		if got := sessionTermination(session, test.doneFirst); got != test.want {
+			t.Errorf("%s: termination %s, want %s", test.name, got, test.want)
+		}
+		endSession(nil)
+		cancel()
+	}
+}
+
+// a failed direction ends the session with the side at fault: the source when reading failed, the destination when writing did
+func TestEndDirection(t *testing.T) {
+	quietLog(t)
+	clientAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 40000}
+	backendAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		want   string
+	}{
+		{name: "client reset", source: sideClient, err: &net.OpError{Op: "read", Addr: clientAddr, Err: syscall.ECONNRESET}, want: TerminationClientError},
+		{name: "backend reset", source: sideBackend, err: &net.OpError{Op: "read", Addr: backendAddr, Err: syscall.ECONNRESET}, want: TerminationBackendError},
+		{name: "writing to the backend failed", source: sideClient, err: &net.OpError{Op: "write", Addr: backendAddr, Err: syscall.EPIPE}, want: TerminationBackendError},
+		{name: "writing to the client failed", source: sideBackend, err: &net.OpError{Op: "write", Addr: clientAddr, Err: syscall.ECONNRESET}, want: TerminationClientError},
+		{name: "spliced to a closed backend", source: sideClient, err: &net.OpError{Op: "readfrom", Err: os.NewSyscallError("splice", syscall.EPIPE)}, want: TerminationBackendError},
+		{name: "spliced from a reset client", source: sideClient, err: &net.OpError{Op: "readfrom", Err: os.NewSyscallError("splice", syscall.ECONNRESET)}, want: TerminationClientError},
+		{name: "end of the stream", source: sideBackend, want: TerminationBackendClosed},
+	}
+	loadBalancer := &LoadBalancer{}
+	for _, test := range tests {
+		session, endSession := startSession(context.Background(), time.Minute)
+		destination, peer := net.Pipe()
+		loadBalancer.endDirection(session, endSession, destination, test.err, test.source)
+		if got := sessionTermination(session, test.source); got != test.want {
+			t.Errorf("%s: termination %s, want %s", test.name, got, test.want)
+		}
+		endSession(nil)
+		destination.Close()
+		peer.Close()
+	}
+}
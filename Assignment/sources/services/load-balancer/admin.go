@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// AdminHandler exposes the runtime admin api of the pools over http
+// every route takes the pool it works on as ?pool=name, it can be left out when there is only one pool
+// GET    /pools                        list the pools
+// GET    /backends                     list the backends with their state
+// POST   /backends                     add a backend: {"url": "host:port", "weight": 1, "priority": 0, "health_check": {"path": "/ready"}}
+// DELETE /backends/{url}               remove a backend, running connections are not cut
+// POST   /backends/{url}/drain         stop sending new connections to a backend
+// POST   /backends/{url}/maintenance   stop sending new connections and stop checking it
+// POST   /backends/{url}/enable        put a backend back in rotation
+// GET    /algorithm                    current algorithm
+// PUT    /algorithm                    switch algorithm: {"algorithm": "leastconn"}
+type AdminHandler struct {
+	pools map[string]*LoadBalancer
+}
+
+// backendStatus is the json representation of a backend in the admin api
+type backendStatus struct {
+	URL               string  `json:"url"`
+	Weight            int     `json:"weight"`
+	Priority          int     `json:"priority"`
+	Alive             bool    `json:"alive"`
+	Ejected           bool    `json:"ejected"`
+	Mode              string  `json:"mode"`
+	ActiveConnections int64   `json:"active_connections"`
+	AverageLatencyMs  float64 `json:"average_latency_ms"`
+	// type and path of the active check, e.g. "http /ready"
+	HealthCheck string `json:"health_check"`
+}
+
+// algorithmRequest is the body of PUT /algorithm
+type algorithmRequest struct {
+	Algorithm string `json:"algorithm"`
+}
+
+// create the admin api for the pools of the balancer
+func createAdminHandler(pools map[string]*LoadBalancer) http.Handler {
+	adminHandler := &AdminHandler{pools: pools}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pools", adminHandler.listPools)
+	mux.HandleFunc("GET /backends", adminHandler.listBackends)
+	mux.HandleFunc("POST /backends", adminHandler.addBackend)
+	mux.HandleFunc("DELETE /backends/{url}", adminHandler.removeBackend)
+	mux.HandleFunc("POST /backends/{url}/drain", adminHandler.setMode(ModeDrain))
+	mux.HandleFunc("POST /backends/{url}/maintenance", adminHandler.setMode(ModeMaintenance))
+	mux.HandleFunc("POST /backends/{url}/enable", adminHandler.setMode(ModeActive))
+	mux.HandleFunc("GET /algorithm", adminHandler.getAlgorithm)
+	mux.HandleFunc("PUT /algorithm", adminHandler.setAlgorithm)
+	return mux
+}
+
+// start the admin api on its own port, it is not reachable through the balanced port
+func serveAdmin(port string, pools map[string]*LoadBalancer) {
+	log.Printf("Admin API listening on :%s", port)
+	if err := http.ListenAndServe(":"+port, createAdminHandler(pools)); err != nil {
+		log.Printf("Admin API failed: %v", err)
+	}
+}
+
+// returns the pool a request works on, writes an error and returns nil if there is none
+func (adminHandler *AdminHandler) pool(writer http.ResponseWriter, receiver *http.Request) *LoadBalancer {
+	name := receiver.URL.Query().Get("pool")
+	if name == "" {
+		if len(adminHandler.pools) == 1 {
+			for _, loadBalancer := range adminHandler.pools {
+				return loadBalancer
+			}
+		}
+		writeError(writer, http.StatusBadRequest, errors.New("?pool= is required when there are several pools"))
+		return nil
+	}
+	loadBalancer, ok := adminHandler.pools[name]
+	if !ok {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("unknown pool %q", name))
+		return nil
+	}
+	return loadBalancer
+}
+
+// list the pools with their algorithm
+func (adminHandler *AdminHandler) listPools(writer http.ResponseWriter, receiver *http.Request) {
+	pools := make(map[string]algorithmRequest, len(adminHandler.pools))
+	for name, loadBalancer := range adminHandler.pools {
+		pools[name] = algorithmRequest{Algorithm: loadBalancer.Algorithm()}
+	}
+	writeJSON(writer, http.StatusOK, pools)
+}
+
+// list all the backends with their health, weight and active connections
+func (adminHandler *AdminHandler) listBackends(writer http.ResponseWriter, receiver *http.Request) {
+	loadBalancer := adminHandler.pool(writer, receiver)
+	if loadBalancer == nil {
+		return
+	}
+	backends := loadBalancer.healthChecker.Backends()
+	statuses := make([]backendStatus, 0, len(backends))
+	for _, backend := range backends {
+		statuses = append(statuses, createBackendStatus(backend))
+	}
+	writeJSON(writer, http.StatusOK, statuses)
+}
+
+// add a backend
+func (adminHandler *AdminHandler) addBackend(writer http.ResponseWriter, receiver *http.Request) {
+	loadBalancer := adminHandler.pool(writer, receiver)
+	if loadBalancer == nil {
+		return
+	}
+	var backendConfig BackendConfig
+	if err := json.NewDecoder(receiver.Body).Decode(&backendConfig); err != nil {
+		writeError(writer, http.StatusBadRequest, errors.New("invalid JSON"))
+		return
+	}
+	if backendConfig.Weight == 0 {
+		backendConfig.Weight = 1
+	}
+	if _, _, err := net.SplitHostPort(backendConfig.URL); err != nil || backendConfig.Weight < 0 || backendConfig.Priority < 0 {
+		writeError(writer, http.StatusBadRequest, errors.New("url must be host:port, weight positive and priority positive or 0"))
+		return
+	}
+	if _, err := backendConfig.HealthCheck.apply(loadBalancer.healthChecker.healthCheck); err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	backend, err := loadBalancer.AddBackend(backendConfig)
+	if err != nil {
+		writeError(writer, http.StatusConflict, err)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, createBackendStatus(backend))
+}
+
+// remove a backend
+func (adminHandler *AdminHandler) removeBackend(writer http.ResponseWriter, receiver *http.Request) {
+	loadBalancer := adminHandler.pool(writer, receiver)
+	if loadBalancer == nil {
+		return
+	}
+	if err := loadBalancer.RemoveBackend(receiver.PathValue("url")); err != nil {
+		writeError(writer, http.StatusNotFound, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// returns a handler that puts a backend in the given administrative mode
+func (adminHandler *AdminHandler) setMode(mode string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, receiver *http.Request) {
+		loadBalancer := adminHandler.pool(writer, receiver)
+		if loadBalancer == nil {
+			return
+		}
+		backendURL := receiver.PathValue("url")
+		backend := loadBalancer.healthChecker.getBackend(backendURL)
+		if backend == nil {
+			writeError(writer, http.StatusNotFound, errors.New("backend "+backendURL+" not found"))
+			return
+		}
+		backend.SetMode(mode)
+		log.Printf("Admin: Backend %s set to %s", backendURL, mode)
+		writeJSON(writer, http.StatusOK, createBackendStatus(backend))
+	}
+}
+
+// return the algorithm in use
+func (adminHandler *AdminHandler) getAlgorithm(writer http.ResponseWriter, receiver *http.Request) {
+	loadBalancer := adminHandler.pool(writer, receiver)
+	if loadBalancer == nil {
+		return
+	}
+	writeJSON(writer, http.StatusOK, algorithmRequest{Algorithm: loadBalancer.Algorithm()})
+}
+
+// switch the algorithm
+func (adminHandler *AdminHandler) setAlgorithm(writer http.ResponseWriter, receiver *http.Request) {
+	loadBalancer := adminHandler.pool(writer, receiver)
+	if loadBalancer == nil {
+		return
+	}
+	var request algorithmRequest
+	if err := json.NewDecoder(receiver.Body).Decode(&request); err != nil {
+		writeError(writer, http.StatusBadRequest, errors.New("invalid JSON"))
+		return
+	}
+	if err := loadBalancer.SetAlgorithm(request.Algorithm); err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, request)
+}
+
+// snapshot the state of a backend for the api
+func createBackendStatus(backend *Backend) backendStatus {
+	healthCheck := backend.activeCheck()
+	return backendStatus{
+		URL:               backend.URL,
+		Weight:            backend.Weight(),
+		Priority:          backend.Priority(),
+		Alive:             backend.IsAlive(),
+		Ejected:           backend.IsEjected(),
+		Mode:              backend.Mode(),
+		HealthCheck:       healthCheck.Type + " " + healthCheck.Path,
+		ActiveConnections: backend.ActiveConnections(),
+		AverageLatencyMs:  float64(backend.AverageLatency().Microseconds()) / 1000,
+	}
+}
+
+// write a value as json with the given status code
+func writeJSON(writer http.ResponseWriter, statusCode int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Printf("Admin: failed to write response: %v", err)
+	}
+}
+
+// write an error as json with the given status code
+func writeError(writer http.ResponseWriter, statusCode int, err error) {
+	writeJSON(writer, statusCode, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// create the admin api of the given pools, every pool is built from a LB_BACKENDS value
+func createTestAdmin(t *testing.T, pools map[string]string) (http.Handler, map[string]*LoadBalancer) {
+	quietLog(t)
+	loadBalancers := make(map[string]*LoadBalancer, len(pools))
+	for name, backends := range pools {
+		config := loadTestConfig(t, map[string]string{"LB_BACKENDS": backends, "LB_HEALTH_TYPE": "none", "LB_METRICS_PORT": "off"})
+		loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+		t.Cleanup(loadBalancer.Stop)
+		loadBalancers[name] = loadBalancer
+	}
+	return createAdminHandler(loadBalancers), loadBalancers
+}
+
+// send a request to the admin api and return the recorded answer
+func adminRequest(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return recorder
+}
+
+func TestAdminRoutes(t *testing.T) {
+	handler, pools := createTestAdmin(t, map[string]string{"users": "user-1:5000,user-2:5000=2@1"})
+	loadBalancer := pools["users"]
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{method: "GET", target: "/pools", want: http.StatusOK},
+		{method: "GET", target: "/backends", want: http.StatusOK},
+		{method: "GET", target: "/backends?pool=users", want: http.StatusOK},
+		{method: "GET", target: "/backends?pool=orders", want: http.StatusNotFound},
+		{method: "POST", target: "/backends", body: `{"url": "user-3:5000", "weight": 3}`, want: http.StatusCreated},
+		{method: "POST", target: "/backends", body: `{"url": "user-3:5000"}`, want: http.StatusConflict},
+		{method: "POST", target: "/backends", body: `{"url": "user-4"}`, want: http.StatusBadRequest},
+		{method: "POST", target: "/backends", body: `{"url": "user-4:5000", "weight": -1}`, want: http.StatusBadRequest},
+		{method: "POST", target: "/backends", body: `{"url": "user-4:5000", "health_check": {"type": "icmp"}}`, want: http.StatusBadRequest},
+		{method: "POST", target: "/backends", body: `not json`, want: http.StatusBadRequest},
+		{method: "POST", target: "/backends/user-1:5000/drain", want: http.StatusOK},
+		{method: "POST", target: "/backends/user-9:5000/drain", want: http.StatusNotFound},
+		{method: "DELETE", target: "/backends/user-3:5000", want: http.StatusNoContent},
+		{method: "DELETE", target: "/backends/user-3:5000", want: http.StatusNotFound},
+		{method: "GET", target: "/algorithm", want: http.StatusOK},
+		{method: "PUT", target: "/algorithm", body: `{"algorithm": "leastconn"}`, want: http.StatusOK},
+		{method: "PUT", target: "/algorithm", body: `{"algorithm": "random"}`, want: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := adminRequest(handler, test.method, test.target, test.body)
+		if recorder.Code != test.want {
+			t.Errorf("%s %s %s = %d %s, want %d", test.method, test.target, test.body, recorder.Code, recorder.Body, test.want)
+		}
+	}
+
+	if got := loadBalancer.Algorithm(); got != "leastconn" {
+		t.Errorf("algorithm = %s after PUT /algorithm, want leastconn", got)
+	}
+	if got := loadBalancer.healthChecker.getBackend("user-1:5000").Mode(); got != ModeDrain {
+		t.Errorf("user-1:5000 is %s after /drain, want %s", got, ModeDrain)
+	}
+	if loadBalancer.healthChecker.getBackend("user-3:5000") != nil {
+		t.Errorf("user-3:5000 is still in the pool after DELETE")
+	}
+}
+
+func TestAdminListBackends(t *testing.T) {
+	handler, _ := createTestAdmin(t, map[string]string{"users": "user-1:5000,user-2:5000=2@1"})
+	adminRequest(handler, "POST", "/backends/user-2:5000/maintenance", "")
+
+	recorder := adminRequest(handler, "GET", "/backends", "")
+	var statuses []backendStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("got %d backends, want 2", len(statuses))
+	}
+	want := backendStatus{URL: "user-2:5000", Weight: 2, Priority: 1, Alive: true, Mode: ModeMaintenance, HealthCheck: "none /healthz"}
+	if statuses[1] != want {
+		t.Errorf("backend = %+v, want %+v", statuses[1], want)
+	}
+}
+
+// the status of a backend can be read while a reload changes its health check
+func TestAdminListDuringUpdate(t *testing.T) {
+	handler, loadBalancers := createTestAdmin(t, map[string]string{"users": "user-1:5000"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			loadBalancers["users"].healthChecker.UpdateBackend(BackendConfig{URL: "user-1:5000", Weight: i + 1, HealthCheck: &BackendHealthCheck{Path: "/ready"}})
+		}
+	}()
+	for range 100 {
+		adminRequest(handler, "GET", "/backends", "")
+	}
+	<-done
+}
+
+// with several pools every route needs ?pool=
+func TestAdminSeveralPools(t *testing.T) {
+	handler, _ := createTestAdmin(t, map[string]string{"users": "user-1:5000", "orders": "order-1:5000"})
+
+	if recorder := adminRequest(handler, "GET", "/backends", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("GET /backends without a pool = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	recorder := adminRequest(handler, "GET", "/backends?pool=orders", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "order-1:5000") {
+		t.Errorf("GET /backends?pool=orders = %d %s", recorder.Code, recorder.Body)
+	}
+	recorder = adminRequest(handler, "GET", "/pools", "")
+	var pools map[string]algorithmRequest
+	if err := json.NewDecoder(recorder.Body).Decode(&pools); err != nil || len(pools) != 2 {
+		t.Errorf("GET /pools = %s, want both pools", recorder.Body)
+	}
+}
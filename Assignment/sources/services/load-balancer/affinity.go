@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// AffinityConfig pins the requests of a user to one backend in http mode
+// the header is checked first, then the cookie, and the requests with neither go through the algorithm
+type AffinityConfig struct {
+	// requests with the same value of this header (e.g. X-User-ID) go to the same backend
+	Header string
+	// name of the cookie the balancer inserts to remember the backend of a client, empty disables it
+	Cookie string
+}
+
+// selectBackend picks the backend of a request, the pinned one if the request has an affinity key
+// and falls back to the algorithm when the pinned backend is not healthy (or already tried) anymore
+// returns the backend and whether the cookie of the client has to be set to it
+func (affinity *AffinityConfig) selectBackend(loadBalancer *LoadBalancer, request *http.Request, clientIP string, excluded map[string]bool) (*Backend, bool) {
+	if affinity == nil {
+		return loadBalancer.selectBackend(clientIP, excluded), false
+	}
+
+	// the header is mapped with consistent hashing: when its backend goes down only its users move
+	if key := request.Header.Get(affinity.Header); affinity.Header != "" && key != "" {
+		if candidates := loadBalancer.candidates(excluded); len(candidates) > 0 {
+			backend := loadBalancer.hasher.pick(key, candidates)
+			loadBalancer.metrics.selectionsTotal.WithLabelValues("affinity", backend.URL).Inc()
+			return backend, false
+		}
+	}
+
+	if affinity.Cookie == "" {
+		return loadBalancer.selectBackend(clientIP, excluded), false
+	}
+	if cookie, err := request.Cookie(affinity.Cookie); err == nil {
+		for _, backend := range loadBalancer.candidates(excluded) {
+			if backendCookieValue(backend) == cookie.Value {
+				loadBalancer.metrics.selectionsTotal.WithLabelValues("affinity", backend.URL).Inc()
+				return backend, false
+			}
+		}
+	}
+	backend := loadBalancer.selectBackend(clientIP, excluded)
+	return backend, backend != nil
+}
+
+// create the affinity cookie pointing to a backend
+func (affinity *AffinityConfig) createCookie(backend *Backend) *http.Cookie {
+	return &http.Cookie{
+		Name:     affinity.Cookie,
+		Value:    backendCookieValue(backend),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// backendCookieValue identifies a backend in the affinity cookie without giving away its address
+func backendCookieValue(backend *Backend) string {
+	return fmt.Sprintf("%016x", hash64(backend.URL))
+}
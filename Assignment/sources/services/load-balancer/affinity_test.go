@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAffinitySelectBackend(t *testing.T) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{
+		"LB_BACKENDS":     "user-1:5000,user-2:5000,user-3:5000",
+		"LB_ALGORITHM":    "roundrobin",
+		"LB_HEALTH_TYPE":  "none",
+		"LB_METRICS_PORT": "off",
+	})
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+	defer loadBalancer.Stop()
+	affinity := &AffinityConfig{Header: "X-User-ID", Cookie: "lb"}
+	cookieOf := func(url string) string {
+		return backendCookieValue(loadBalancer.healthChecker.getBackend(url))
+	}
+	headerBackend, _ := affinity.selectBackend(loadBalancer, requestWith("user-42", ""), "10.0.0.1", nil)
+	otherBackend := "user-1:5000"
+	if headerBackend.URL == otherBackend {
+		otherBackend = "user-2:5000"
+	}
+
+	tests := []struct {
+		name     string
+		affinity *AffinityConfig
+		header   string
+		cookie   string
+		excluded map[string]bool
+		// empty when any backend but the excluded ones will do
+		want          string
+		wantSetCookie bool
+	}{
+		{name: "disabled", cookie: cookieOf("user-2:5000")},
+		{name: "header", affinity: affinity, header: "user-42", want: headerBackend.URL},
+		{name: "header wins over the cookie", affinity: affinity, header: "user-42", cookie: cookieOf(otherBackend), want: headerBackend.URL},
+		{name: "header of a backend already tried", affinity: affinity, header: "user-42", excluded: map[string]bool{headerBackend.URL: true}},
+		{name: "cookie", affinity: affinity, cookie: cookieOf("user-2:5000"), want: "user-2:5000"},
+		{name: "cookie of a backend already tried", affinity: affinity, cookie: cookieOf("user-2:5000"), excluded: map[string]bool{"user-2:5000": true}, wantSetCookie: true},
+		{name: "cookie of an unknown backend", affinity: affinity, cookie: "0000000000000000", wantSetCookie: true},
+		{name: "no cookie yet", affinity: affinity, wantSetCookie: true},
+		{name: "header only", affinity: &AffinityConfig{Header: "X-User-ID"}, cookie: cookieOf("user-2:5000")},
+	}
+	for _, test := range tests {
+		// the same request always lands on the same backend
+		var first *Backend
+		for range 3 {
+			backend, setCookie := test.affinity.selectBackend(loadBalancer, requestWith(test.header, test.cookie), "10.0.0.1", test.excluded)
+			if backend == nil {
+				t.Fatalf("%s: no backend", test.name)
+			}
+			if setCookie != test.wantSetCookie {
+				t.Errorf("%s: setCookie = %v, want %v", test.name, setCookie, test.wantSetCookie)
+			}
+			if test.excluded[backend.URL] {
+				t.Errorf("%s: picked %s which was already tried", test.name, backend.URL)
+			}
+			if test.want == "" {
+				continue
+			}
+			if backend.URL != test.want {
+				t.Errorf("%s: picked %s, want %s", test.name, backend.URL, test.want)
+			}
+			if first != nil && backend != first {
+				t.Errorf("%s: picked %s then %s", test.name, first.URL, backend.URL)
+			}
+			first = backend
+		}
+	}
+}
+
+// the cookie set by the balancer leads back to its backend
+func TestAffinityCookie(t *testing.T) {
+	affinity := &AffinityConfig{Cookie: "lb"}
+	backend := createBackend(BackendConfig{URL: "10.0.0.1:5000", Weight: 1}, &HealthCheckConfig{})
+	cookie := affinity.createCookie(backend)
+	if cookie.Name != "lb" || cookie.Value != backendCookieValue(backend) || !cookie.HttpOnly {
+		t.Errorf("cookie %v", cookie)
+	}
+	if cookie.Value == backend.URL || len(cookie.Value) != 16 {
+		t.Errorf("cookie value %q should hide the address of the backend", cookie.Value)
+	}
+	other := createBackend(BackendConfig{URL: "10.0.0.2:5000", Weight: 1}, &HealthCheckConfig{})
+	if backendCookieValue(other) == cookie.Value {
+		t.Errorf("two backends share the cookie value %q", cookie.Value)
+	}
+}
+
+// create a request with the given X-User-ID header and lb cookie, empty ones are left out
+func requestWith(header string, cookie string) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		request.Header.Set("X-User-ID", header)
+	}
+	if cookie != "" {
+		request.AddCookie(&http.Cookie{Name: "lb", Value: cookie})
+	}
+	return request
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Topology is everything one balancer process serves: the backend pools and the listeners in front of them
+type Topology struct {
+	// process wide settings
+	MetricsPort   string
+	AdminPort     string
+	ShutdownGrace time.Duration
+	// how often LB_CONFIG_FILE is checked for changes, 0 only reloads it on SIGHUP
+	ReloadInterval time.Duration
+	// access log shared by all the listeners, nil when disabled
+	AccessLog *AccessLogConfig
+	// config of every pool by name, each pool is one LoadBalancer (backends, algorithm, health checks, rates...)
+	Pools map[string]*Config
+	// the ports of the balancer, in the order of the file
+	Listeners []ListenerConfig
+}
+
+// ListenerConfig is one port of the balancer and the pool it forwards to
+type ListenerConfig struct {
+	Name string
+	Pool string
+	// settings of the listener itself: port, connection limits, timeouts, per connection rates, PROXY protocol and TLS,
+	// the rest comes from its pool
+	Config *Config
+	// server name -> pool for the TLS routing, on top of LB_SNI_ROUTES
+	Routes map[string]string
+}
+
+// configFile is the layout of LB_CONFIG_FILE, for example:
+//
+//	{
+//	  "settings": {"metrics_port": 9100, "health_type": "http"},
+//	  "pools": {
+//	    "users": {"backends": ["user-service-1:5000", "user-service-2:5000"], "algorithm": "leastconn",
+//	              "backend_health": {"user-service-2:5000": {"type": "http", "path": "/ready"}}},
+//	    "posts": {"backends": ["post-service:5000"], "rate": 50}
+//	  },
+//	  "listeners": [
+//	    {"name": "users", "port": 8080, "pool": "users"},
+//	    {"name": "posts", "port": 8081, "pool": "posts", "max_conns_per_ip": 100}
+//	  ]
+//	}
+//
+// a setting is the name of its environment variable in lowercase without LB_ (health_type is LB_HEALTH_TYPE)
+// a listener setting overrides the one of its pool, which overrides the top level settings, which override the environment
+// the settings of the pool itself (poolOnlySettings: backends, algorithm, health checks, backend connections
+// and the limits shared by all its connections) can only be set on the pool, a listener setting them is an error
+type configFile struct {
+	Settings  map[string]settingValue            `json:"settings"`
+	Pools     map[string]map[string]settingValue `json:"pools"`
+	Listeners []listenerFile                     `json:"listeners"`
+}
+
+// listenerFile is a listener of the config file: name, pool and routes, everything else is a setting
+type listenerFile struct {
+	Name     string
+	Pool     string
+	Routes   map[string]string
+	Settings map[string]settingValue
+}
+
+// poolOnlySettings are read once per pool, they are shared by all the listeners of the pool
+// and can not be overridden by one listener (the listener uses the load balancer and the dialer of its pool)
+var poolOnlySettings = []string{
+	"backends", "backend_health", "algorithm", "priority_threshold", "slow_start",
+	"hash_mode", "hash_vnodes",
+	"health_type", "health_path", "health_status", "health_body", "health_send",
+	"health_interval", "health_timeout", "health_jitter", "health_rise", "health_fall",
+	"outlier_ejection", "outlier_failures", "outlier_max_ejection", "outlier_max_ejection_percent", "outlier_short_session",
+	"discovery_dns", "discovery_type", "discovery_port", "discovery_server", "discovery_interval",
+	"connect_attempts", "connect_timeout", "tcp_keepalive", "tcp_keepalive_interval", "tcp_keepalive_count",
+	"client_rate_up", "client_rate_down",
+	"backend_rate_up", "backend_rate_down",
+	"global_rate_up", "global_rate_down",
+}
+
+// settingValue is a setting of the config file, numbers, booleans and lists are turned into
+// the string the environment variable would hold (lists are joined with commas)
+type settingValue string
+
+// load the pools and listeners from LB_CONFIG_FILE, or a single pool and listener from the environment when it is not set
+func loadTopology() (*Topology, error) {
+	path := os.Getenv("LB_CONFIG_FILE")
+	if path == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+		accessLog, err := loadAccessLogConfig(os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		return &Topology{
+			MetricsPort:   config.MetricsPort,
+			AdminPort:     config.AdminPort,
+			ShutdownGrace: config.ShutdownGrace,
+			AccessLog:     accessLog,
+			Pools:         map[string]*Config{"default": config},
+			Listeners:     []ListenerConfig{{Name: "default", Pool: "default", Config: config}},
+		}, nil
+	}
+	return loadConfigFile(path)
+}
+
+// parse and validate the config file
+func loadConfigFile(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var file configFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if len(file.Pools) == 0 || len(file.Listeners) == 0 {
+		return nil, errors.New("the config file needs at least one pool and one listener")
+	}
+
+	global := layeredSettings(os.Getenv, file.Settings)
+	topology := &Topology{
+		MetricsPort: loadMetricsPort(global),
+		AdminPort:   global("LB_ADMIN_PORT"),
+		Pools:       make(map[string]*Config),
+	}
+	if topology.ShutdownGrace, err = getEnvDuration(global, "LB_SHUTDOWN_GRACE", defaultShutdownGrace); err != nil {
+		return nil, err
+	}
+	if topology.ReloadInterval, err = getEnvDuration(global, "LB_CONFIG_RELOAD_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if topology.AccessLog, err = loadAccessLogConfig(global); err != nil {
+		return nil, err
+	}
+
+	for name, poolSettings := range file.Pools {
+		config, err := loadConfig(layeredSettings(os.Getenv, file.Settings, poolSettings))
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		topology.Pools[name] = config
+	}
+
+	ports := make(map[string]string)
+	for i, listener := range file.Listeners {
+		if listener.Name == "" {
+			listener.Name = "listener-" + strconv.Itoa(i+1)
+		}
+		poolSettings, ok := file.Pools[listener.Pool]
+		if !ok {
+			return nil, fmt.Errorf("listener %s: unknown pool %q", listener.Name, listener.Pool)
+		}
+		for _, key := range poolOnlySettings {
+			if _, ok := listener.Settings[key]; ok {
+				return nil, fmt.Errorf("listener %s: %s is shared by the pool, set it on pool %s", listener.Name, key, listener.Pool)
+			}
+		}
+		for serverName, pool := range listener.Routes {
+			if _, ok := file.Pools[pool]; !ok {
+				return nil, fmt.Errorf("listener %s: unknown pool %q in the route of %s", listener.Name, pool, serverName)
+			}
+		}
+
+		config, err := loadConfig(layeredSettings(os.Getenv, file.Settings, poolSettings, listener.Settings))
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", listener.Name, err)
+		}
+		if len(listener.Routes) > 0 && config.TLS == nil {
+			return nil, fmt.Errorf("listener %s: routes need tls_mode to be set", listener.Name)
+		}
+		// a udp and a tcp listener can share a port number, like dns does
+		network := ListenerModeTCP
+		if config.Mode == ListenerModeUDP {
+			network = ListenerModeUDP
+		}
+		if other, used := ports[network+"/"+config.Port]; used {
+			return nil, fmt.Errorf("listener %s: port %s is already used by %s", listener.Name, config.Port, other)
+		}
+		ports[network+"/"+config.Port] = listener.Name
+
+		topology.Listeners = append(topology.Listeners, ListenerConfig{
+			Name:   listener.Name,
+			Pool:   listener.Pool,
+			Config: config,
+			Routes: listener.Routes,
+		})
+	}
+	return topology, nil
+}
+
+// layeredSettings looks a setting up in the layers of the config file, the last layer wins,
+// and falls back to the environment when no layer sets it
+func layeredSettings(fallback settings, layers ...map[string]settingValue) settings {
+	return func(key string) string {
+		name := strings.ToLower(strings.TrimPrefix(key, "LB_"))
+		for i := len(layers) - 1; i >= 0; i-- {
+			if value, ok := layers[i][name]; ok {
+				return string(value)
+			}
+		}
+		return fallback(key)
+	}
+}
+
+// UnmarshalJSON takes the name, pool and routes out of a listener and keeps the rest as settings
+func (listener *listenerFile) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	reserved := map[string]any{"name": &listener.Name, "pool": &listener.Pool, "routes": &listener.Routes}
+	for key, target := range reserved {
+		if raw, ok := fields[key]; ok {
+			if err := json.Unmarshal(raw, target); err != nil {
+				return fmt.Errorf("invalid listener %s: %w", key, err)
+			}
+			delete(fields, key)
+		}
+	}
+
+	listener.Settings = make(map[string]settingValue, len(fields))
+	for key, raw := range fields {
+		var value settingValue
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		listener.Settings[key] = value
+	}
+	return nil
+}
+
+// UnmarshalJSON turns a json string, number, boolean or list of those into the string of a setting
+func (value *settingValue) UnmarshalJSON(data []byte) error {
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	str, err := settingString(decoded)
+	if err != nil {
+		return err
+	}
+	*value = settingValue(str)
+	return nil
+}
+
+// settingString formats a decoded json value the way it would be written in an environment variable
+func settingString(decoded any) (string, error) {
+	switch decoded := decoded.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return decoded, nil
+	case float64:
+		return strconv.FormatFloat(decoded, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(decoded), nil
+	case map[string]any:
+		// an object (like backend_health) is kept as the json the environment variable would hold
+		encoded, err := json.Marshal(decoded)
+		return string(encoded), err
+	case []any:
+		items := make([]string, len(decoded))
+		for i, item := range decoded {
+			str, err := settingString(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = str
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.New("a setting must be a string, number, boolean, list or object")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write a config file in a temporary directory and return its path
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// a listener setting overrides its pool, which overrides the top level settings
+func TestLoadConfigFileLayering(t *testing.T) {
+	quietLog(t)
+	topology, err := loadConfigFile(writeConfigFile(t, `{
+		"settings": {"idle_timeout": "10s", "max_session_lifetime": "1h", "rate": 10, "metrics_port": "off"},
+		"pools": {
+			"users": {"backends": ["user-1:5000", "user-2:5000"], "idle_timeout": "20s", "rate": 20, "backend_rate_up": 5},
+			"posts": {"backends": "post-1:5000"}
+		},
+		"listeners": [
+			{"name": "users", "port": 8080, "pool": "users", "idle_timeout": "30s", "proxy_protocol_send": "v2", "rate_down": 40},
+			{"name": "posts", "port": 8081, "pool": "posts"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := topology.Pools["users"]
+	if users.IdleTimeout != 20*time.Second || users.MaxSessionLifetime != time.Hour || users.ProxyProtocolSend != "" {
+		t.Errorf("pool users: idle %s, lifetime %s, proxy %q", users.IdleTimeout, users.MaxSessionLifetime, users.ProxyProtocolSend)
+	}
+	if len(users.Backends) != 2 || users.Bandwidth.BackendUp != 5 {
+		t.Errorf("pool users: backends %v, backend rate up %v", users.Backends, users.Bandwidth.BackendUp)
+	}
+
+	listener := topology.Listeners[0].Config
+	if listener.IdleTimeout != 30*time.Second || listener.MaxSessionLifetime != time.Hour || listener.ProxyProtocolSend != "v2" || listener.Port != "8080" {
+		t.Errorf("listener users: idle %s, lifetime %s, proxy %q, port %s", listener.IdleTimeout, listener.MaxSessionLifetime, listener.ProxyProtocolSend, listener.Port)
+	}
+	if listener.Bandwidth.ConnectionUp != 20 || listener.Bandwidth.ConnectionDown != 40 {
+		t.Errorf("listener users: rates up %v down %v, want 20 and 40", listener.Bandwidth.ConnectionUp, listener.Bandwidth.ConnectionDown)
+	}
+
+	posts := topology.Listeners[1].Config
+	if posts.IdleTimeout != 10*time.Second || posts.Bandwidth.ConnectionUp != 10 {
+		t.Errorf("listener posts: idle %s, rate %v, want the top level settings", posts.IdleTimeout, posts.Bandwidth.ConnectionUp)
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	quietLog(t)
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "shared limit on a listener",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}, "listeners": [{"port": 8080, "pool": "users", "client_rate_up": 5}]}`,
+			wantErr: "client_rate_up is shared by the pool",
+		},
+		{
+			name:    "algorithm on a listener",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}, "listeners": [{"port": 8080, "pool": "users", "algorithm": "leastconn"}]}`,
+			wantErr: "listener listener-1: algorithm is shared by the pool, set it on pool users",
+		},
+		{
+			name:    "health check on a listener",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}, "listeners": [{"port": 8080, "pool": "users", "health_path": "/ready"}]}`,
+			wantErr: "health_path is shared by the pool",
+		},
+		{
+			name:    "connect timeout on a listener",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}, "listeners": [{"port": 8080, "pool": "users", "connect_timeout": "1s"}]}`,
+			wantErr: "connect_timeout is shared by the pool",
+		},
+		{
+			name:    "bandwidth limit on a udp listener",
+			content: `{"pools": {"dns": {"backends": "dns-1:53"}}, "listeners": [{"port": 53, "pool": "dns", "mode": "udp", "rate": 5}]}`,
+			wantErr: "udp does not support the bandwidth limits, unset LB_RATE",
+		},
+		{
+			name:    "shared limit on the pool of a udp listener",
+			content: `{"pools": {"dns": {"backends": "dns-1:53", "global_rate_down": 5}}, "listeners": [{"port": 53, "pool": "dns", "mode": "udp"}]}`,
+			wantErr: "unset LB_GLOBAL_RATE_DOWN",
+		},
+		{
+			name:    "unknown pool",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}, "listeners": [{"port": 8080, "pool": "posts"}]}`,
+			wantErr: `unknown pool "posts"`,
+		},
+		{
+			name:    "same port twice",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}, "listeners": [{"port": 8080, "pool": "users"}, {"port": 8080, "pool": "users"}]}`,
+			wantErr: "already used",
+		},
+		{
+			name:    "no listener",
+			content: `{"pools": {"users": {"backends": "user-1:5000"}}}`,
+			wantErr: "at least one pool and one listener",
+		},
+		{
+			name:    "unknown field",
+			content: `{"pool": {}}`,
+			wantErr: "unknown field",
+		},
+	}
+	for _, test := range tests {
+		_, err := loadConfigFile(writeConfigFile(t, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
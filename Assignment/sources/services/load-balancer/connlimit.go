@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// how often the per IP entries of clients without connections are cleaned up
+const connectionLimiterSweep = time.Minute
+
+// ConnectionLimitConfig limits the connections the balancer accepts, 0 means unlimited
+type ConnectionLimitConfig struct {
+	// concurrent connections of a single client IP
+	MaxPerIP int
+	// new connections per second of a single client IP (token bucket)
+	RatePerIP  float64
+	BurstPerIP int
+	// concurrent connections of the whole balancer
+	MaxConnections int
+	// once MaxConnections is reached up to QueueSize new connections wait QueueTimeout for a free slot,
+	// with QueueSize 0 they are rejected immediately
+	QueueSize    int
+	QueueTimeout time.Duration
+}
+
+// ConnectionLimiter decides if a newly accepted connection may be handled
+type ConnectionLimiter struct {
+	config *ConnectionLimitConfig
+	// global slots (nil if unlimited) and the tickets of the accept queue
+	slots chan struct{}
+	queue chan struct{}
+
+	mutex     sync.Mutex
+	clients   map[string]*clientConnections
+	lastSweep time.Time
+}
+
+// clientConnections is the state of a client IP, protected by the mutex of the ConnectionLimiter
+type clientConnections struct {
+	active  int
+	limiter *rate.Limiter
+}
+
+// reasons a connection is rejected for, used in the logs and as metrics label
+const (
+	RejectMaxPerIP     = "max_per_ip"
+	RejectRatePerIP    = "rate_per_ip"
+	RejectMaxConns     = "max_connections"
+	RejectQueueFull    = "queue_full"
+	RejectQueueTimeout = "queue_timeout"
+	RejectShuttingDown = "shutting_down"
+	RejectProxyHeader  = "proxy_header"
+	RejectTLSHandshake = "tls_handshake"
+)
+
+// create the connection limiter from its config
+func createConnectionLimiter(config *ConnectionLimitConfig) *ConnectionLimiter {
+	limiter := &ConnectionLimiter{
+		config:    config,
+		clients:   make(map[string]*clientConnections),
+		lastSweep: time.Now(),
+	}
+	if config.MaxConnections > 0 {
+		limiter.slots = make(chan struct{}, config.MaxConnections)
+		limiter.queue = make(chan struct{}, config.QueueSize)
+	}
+	return limiter
+}
+
+// admit checks the per IP and global limits for a new connection of the client
+// it may wait in the accept queue for a free global slot, until ctx is cancelled
+// returns a release function to call when the connection ends, or the reason of the rejection
+func (limiter *ConnectionLimiter) admit(ctx context.Context, clientIP string) (func(), string) {
+	if reason := limiter.admitClient(clientIP); reason != "" {
+		return nil, reason
+	}
+
+	if reason := limiter.acquireSlot(ctx); reason != "" {
+		limiter.releaseClient(clientIP)
+		return nil, reason
+	}
+
+	release := func() {
+		if limiter.slots != nil {
+			<-limiter.slots
+		}
+		limiter.releaseClient(clientIP)
+	}
+	return release, ""
+}
+
+// releasingConn gives the slots of a connection back to the limiter when it is closed
+type releasingConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+// wrap an admitted connection so closing it releases its slots
+func createReleasingConn(connection net.Conn, release func()) net.Conn {
+	return &releasingConn{Conn: connection, release: release}
+}
+
+// Close closes the connection and releases its slots, only once whatever the number of calls
+func (connection *releasingConn) Close() error {
+	err := connection.Conn.Close()
+	connection.releaseOnce.Do(connection.release)
+	return err
+}
+
+// NetConn returns the wrapped connection, closing it does not release the slots
+func (connection *releasingConn) NetConn() net.Conn {
+	return connection.Conn
+}
+
+// check and count the connection against the limits of its client IP
+func (limiter *ConnectionLimiter) admitClient(clientIP string) string {
+	config := limiter.config
+	if config.MaxPerIP == 0 && config.RatePerIP == 0 {
+		return ""
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.sweep()
+
+	client, ok := limiter.clients[clientIP]
+	if !ok {
+		client = &clientConnections{}
+		if config.RatePerIP > 0 {
+			client.limiter = rate.NewLimiter(rate.Limit(config.RatePerIP), config.BurstPerIP)
+		}
+		limiter.clients[clientIP] = client
+	}
+
+	if config.MaxPerIP > 0 && client.active >= config.MaxPerIP {
+		return RejectMaxPerIP
+	}
+	if client.limiter != nil && !client.limiter.Allow() {
+		return RejectRatePerIP
+	}
+	client.active++
+	return ""
+}
+
+// a connection of the client ended
+func (limiter *ConnectionLimiter) releaseClient(clientIP string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if client, ok := limiter.clients[clientIP]; ok {
+		client.active--
+	}
+}
+
+// forget the clients without connections whose token bucket is full again (caller holds the mutex)
+// dropping them earlier would hand out a fresh burst to a client that just used it
+func (limiter *ConnectionLimiter) sweep() {
+	if time.Since(limiter.lastSweep) < connectionLimiterSweep {
+		return
+	}
+	limiter.lastSweep = time.Now()
+	for clientIP, client := range limiter.clients {
+		if client.active > 0 {
+			continue
+		}
+		if client.limiter == nil || client.limiter.Tokens() >= float64(client.limiter.Burst()) {
+			delete(limiter.clients, clientIP)
+		}
+	}
+}
+
+// take a global slot, waiting in the accept queue if it is configured
+func (limiter *ConnectionLimiter) acquireSlot(ctx context.Context) string {
+	if limiter.slots == nil {
+		return ""
+	}
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return ""
+	default:
+	}
+
+	// every slot is taken: wait in the queue if there is room in it
+	select {
+	case limiter.queue <- struct{}{}:
+	default:
+		if limiter.config.QueueSize == 0 {
+			return RejectMaxConns
+		}
+		return RejectQueueFull
+	}
+	defer func() { <-limiter.queue }()
+
+	timer := time.NewTimer(limiter.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case limiter.slots <- struct{}{}:
+		return ""
+	case <-timer.C:
+		return RejectQueueTimeout
+	case <-ctx.Done():
+		return RejectShuttingDown
+	}
+}
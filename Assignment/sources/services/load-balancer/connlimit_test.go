@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmitPerIP(t *testing.T) {
+	limiter := createConnectionLimiter(&ConnectionLimitConfig{MaxPerIP: 2})
+
+	var releases []func()
+	for i := range 2 {
+		release, reason := limiter.admit(context.Background(), "10.0.0.1")
+		if reason != "" {
+			t.Fatalf("connection %d rejected: %s", i+1, reason)
+		}
+		releases = append(releases, release)
+	}
+	if _, reason := limiter.admit(context.Background(), "10.0.0.1"); reason != RejectMaxPerIP {
+		t.Errorf("third connection of a client = %q, want %q", reason, RejectMaxPerIP)
+	}
+	if _, reason := limiter.admit(context.Background(), "10.0.0.2"); reason != "" {
+		t.Errorf("another client was rejected: %s", reason)
+	}
+	releases[0]()
+	if _, reason := limiter.admit(context.Background(), "10.0.0.1"); reason != "" {
+		t.Errorf("connection after a release rejected: %s", reason)
+	}
+}
+
+func TestAdmitRatePerIP(t *testing.T) {
+	limiter := createConnectionLimiter(&ConnectionLimitConfig{RatePerIP: 1, BurstPerIP: 3})
+
+	for i := range 3 {
+		release, reason := limiter.admit(context.Background(), "10.0.0.1")
+		if reason != "" {
+			t.Fatalf("connection %d of the burst rejected: %s", i+1, reason)
+		}
+		// closing the connections does not give the tokens back
+		release()
+	}
+	if _, reason := limiter.admit(context.Background(), "10.0.0.1"); reason != RejectRatePerIP {
+		t.Errorf("connection after the burst = %q, want %q", reason, RejectRatePerIP)
+	}
+}
+
+func TestAdmitMaxConnections(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ConnectionLimitConfig
+		// cancel the context of the waiting connection
+		cancel bool
+		want   string
+	}{
+		{name: "no queue", config: ConnectionLimitConfig{MaxConnections: 1}, want: RejectMaxConns},
+		{name: "queue timeout", config: ConnectionLimitConfig{MaxConnections: 1, QueueSize: 1, QueueTimeout: 20 * time.Millisecond}, want: RejectQueueTimeout},
+		{name: "shutting down", config: ConnectionLimitConfig{MaxConnections: 1, QueueSize: 1, QueueTimeout: time.Minute}, cancel: true, want: RejectShuttingDown},
+	}
+	for _, test := range tests {
+		limiter := createConnectionLimiter(&test.config)
+		release, reason := limiter.admit(context.Background(), "10.0.0.1")
+		if reason != "" {
+			t.Fatalf("%s: first connection rejected: %s", test.name, reason)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			cancel()
+		}
+		if _, reason := limiter.admit(ctx, "10.0.0.2"); reason != test.want {
+			t.Errorf("%s: second connection = %q, want %q", test.name, reason, test.want)
+		}
+		cancel()
+		release()
+	}
+}
+
+// a queued connection gets the slot of a connection that ends, the queue itself is bounded
+func TestAdmitQueue(t *testing.T) {
+	limiter := createConnectionLimiter(&ConnectionLimitConfig{MaxConnections: 1, QueueSize: 1, QueueTimeout: time.Minute})
+	release, _ := limiter.admit(context.Background(), "10.0.0.1")
+
+	queued := make(chan string)
+	go func() {
+		_, reason := limiter.admit(context.Background(), "10.0.0.2")
+		queued <- reason
+	}()
+	// wait until the connection is in the queue
+	for len(limiter.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, reason := limiter.admit(context.Background(), "10.0.0.3"); reason != RejectQueueFull {
+		t.Errorf("connection with a full queue = %q, want %q", reason, RejectQueueFull)
+	}
+
+	release()
+	select {
+	case reason := <-queued:
+		if reason != "" {
+			t.Errorf("queued connection rejected: %s", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the queued connection did not get the free slot")
+	}
+}
+
+// closing a connection twice releases its slot once
+func TestReleasingConn(t *testing.T) {
+	limiter := createConnectionLimiter(&ConnectionLimitConfig{MaxPerIP: 1, MaxConnections: 2})
+	release, _ := limiter.admit(context.Background(), "10.0.0.1")
+	client, server := net.Pipe()
+	defer server.Close()
+
+	connection := createReleasingConn(client, release)
+	connection.Close()
+	connection.Close()
+	if len(limiter.slots) != 0 || limiter.clients["10.0.0.1"].active != 0 {
+		t.Errorf("after two closes: %d slots taken, %d connections of the client", len(limiter.slots), limiter.clients["10.0.0.1"].active)
+	}
+}
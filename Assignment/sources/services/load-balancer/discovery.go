@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// record types of the dns discovery (LB_DISCOVERY_TYPE)
+const (
+	// A and AAAA records of the name, every address is a backend on the configured port
+	DiscoveryTypeA = "a"
+	// SRV records of the name, every target address is a backend with the port, weight and priority of its record
+	DiscoveryTypeSRV = "srv"
+)
+
+// DiscoveryConfig resolves a dns name into backends of the pool, nil when disabled
+type DiscoveryConfig struct {
+	// host name to resolve, the full SRV name (_http._tcp.user-service) for srv
+	Name string
+	Type string
+	// port of the backends found with A/AAAA records
+	Port     string
+	Interval time.Duration
+	// dns server to ask (host:port), empty for the resolver of the system
+	Server string
+}
+
+// String describes the discovery for the logs
+func (config *DiscoveryConfig) String() string {
+	if config.Type == DiscoveryTypeA {
+		return fmt.Sprintf("%s:%s (A/AAAA)", config.Name, config.Port)
+	}
+	return fmt.Sprintf("%s (SRV)", config.Name)
+}
+
+// Resolver is the part of net.Resolver the discovery uses, a stub answers instead of a dns server in tests
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery keeps the backends of a pool in sync with a dns name, so scaling a service
+// (docker compose --scale user-service=5) reaches the balancer without touching LB_BACKENDS
+// a new address is added like with the admin api: down until its first probe succeeded
+// an address that is no longer resolved is drained, its running connections end by themselves
+// the backends of LB_BACKENDS, the config file and the admin api are left alone
+type DNSDiscovery struct {
+	loadBalancer *LoadBalancer
+	config       *DiscoveryConfig
+	resolver     Resolver
+
+	// backends added by the discovery by url, only touched by the refresh loop
+	discovered map[string]BackendConfig
+	// backends the discovery drained because they vanished, the only drained ones it may put back in rotation
+	drainedByDiscovery map[string]bool
+	stop               chan struct{}
+	stopOnce           sync.Once
+	done               chan struct{}
+}
+
+// create the discovery of a pool, nothing is resolved until Start is called
+func createDNSDiscovery(loadBalancer *LoadBalancer, config *DiscoveryConfig, resolver Resolver) *DNSDiscovery {
+	return &DNSDiscovery{
+		loadBalancer:       loadBalancer,
+		config:             config,
+		resolver:           resolver,
+		discovered:         make(map[string]BackendConfig),
+		drainedByDiscovery: make(map[string]bool),
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+}
+
+// create the resolver of the discovery, one that only asks the given dns server when it is set
+func createResolver(server string) Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Start resolves the name right away and then every interval until Stop is called
+func (discovery *DNSDiscovery) Start() {
+	log.Printf("Discovery: resolving %s every %s", discovery.config, discovery.config.Interval)
+	go func() {
+		defer close(discovery.done)
+		ticker := time.NewTicker(discovery.config.Interval)
+		defer ticker.Stop()
+		for {
+			discovery.refresh()
+			select {
+			case <-discovery.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops resolving, the discovered backends stay in the pool
+func (discovery *DNSDiscovery) Stop() {
+	discovery.stopOnce.Do(func() { close(discovery.stop) })
+	<-discovery.done
+}
+
+// refresh resolves the name once and applies the difference to the pool
+// a failed lookup keeps the backends we have, a dns hiccup must not empty the pool
+func (discovery *DNSDiscovery) refresh() {
+	// the lookup may not take longer than the interval, the next one would be late
+	ctx, cancel := context.WithTimeout(context.Background(), discovery.config.Interval)
+	defer cancel()
+	backends, err := discovery.resolve(ctx)
+	if err != nil {
+		log.Printf("Discovery: failed to resolve %s, keeping the %d discovered backends: %v", discovery.config.Name, len(discovery.discovered), err)
+		return
+	}
+	discovery.apply(backends)
+}
+
+// resolve looks the name up and returns the backends it points to, by url
+func (discovery *DNSDiscovery) resolve(ctx context.Context) (map[string]BackendConfig, error) {
+	backends := make(map[string]BackendConfig)
+	if discovery.config.Type == DiscoveryTypeA {
+		addresses, err := discovery.resolver.LookupIPAddr(ctx, discovery.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			url := net.JoinHostPort(address.String(), discovery.config.Port)
+			backends[url] = BackendConfig{URL: url, Weight: 1}
+		}
+		return backends, nil
+	}
+
+	_, records, err := discovery.resolver.LookupSRV(ctx, "", "", discovery.config.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		addresses, err := discovery.resolver.LookupIPAddr(ctx, strings.TrimSuffix(record.Target, "."))
+		if err != nil {
+			// the other targets are still worth using
+			log.Printf("Discovery: failed to resolve target %s of %s: %v", record.Target, discovery.config.Name, err)
+			continue
+		}
+		for _, address := range addresses {
+			url := net.JoinHostPort(address.String(), strconv.Itoa(int(record.Port)))
+			// an SRV weight of 0 means "rarely", our weights start at 1
+			// a lower SRV priority is preferred like our priority levels, so the value is used as is
+			backends[url] = BackendConfig{URL: url, Weight: max(int(record.Weight), 1), Priority: int(record.Priority)}
+		}
+	}
+	if len(backends) == 0 && len(records) > 0 {
+		return nil, errors.New("no target could be resolved")
+	}
+	return backends, nil
+}
+
+// apply adds the new backends, updates the ones whose SRV weight or priority changed and drains the vanished ones
+// the same diff as a config reload (see reconfigure in reload.go)
+func (discovery *DNSDiscovery) apply(backends map[string]BackendConfig) {
+	healthChecker := discovery.loadBalancer.healthChecker
+	for url, backendConfig := range backends {
+		old, existed := discovery.discovered[url]
+		running := healthChecker.getBackend(url)
+
+		switch {
+		case running == nil:
+			if _, err := discovery.loadBalancer.AddBackend(backendConfig); err != nil {
+				log.Printf("Discovery: failed to add backend %s: %v", url, err)
+				continue
+			}
+			log.Printf("Discovery: backend %s found", url)
+		case !existed && discovery.drainedByDiscovery[url] && running.Mode() == ModeDrain:
+			// vanished on an earlier lookup and still draining, put it back in rotation
+			running.SetMode(ModeActive)
+			healthChecker.UpdateBackend(backendConfig)
+			log.Printf("Discovery: backend %s is back", url)
+		case !existed:
+			// configured by other means or drained by an operator, not ours to touch
+			continue
+		case old != backendConfig:
+			healthChecker.UpdateBackend(backendConfig)
+		}
+		discovery.discovered[url] = backendConfig
+		delete(discovery.drainedByDiscovery, url)
+	}
+
+	for url := range discovery.discovered {
+		if _, ok := backends[url]; ok {
+			continue
+		}
+		delete(discovery.discovered, url)
+		log.Printf("Discovery: backend %s is gone", url)
+		if err := discovery.loadBalancer.DrainBackend(url); err != nil {
+			// removed with the admin api meanwhile
+			log.Printf("Discovery: %v", err)
+			continue
+		}
+		discovery.drainedByDiscovery[url] = true
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// stubResolver answers the lookups of the discovery from maps instead of a dns server
+type stubResolver struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+	err   error
+}
+
+func (resolver *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if resolver.err != nil {
+		return nil, resolver.err
+	}
+	addresses, ok := resolver.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var ipAddrs []net.IPAddr
+	for _, address := range addresses {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: net.ParseIP(address)})
+	}
+	return ipAddrs, nil
+}
+
+func (resolver *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if resolver.err != nil {
+		return "", nil, resolver.err
+	}
+	records, ok := resolver.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+// create a pool with the given static backends and a discovery of the stub resolver
+// the refreshes are run by the test, the refresh loop is not started
+func createTestDiscovery(t *testing.T, backends string, config *DiscoveryConfig, resolver Resolver) *DNSDiscovery {
+	quietLog(t)
+	poolConfig := loadTestConfig(t, map[string]string{"LB_BACKENDS": backends, "LB_METRICS_PORT": "off"})
+	loadBalancer := createLoadBalancer(poolConfig, sharedMetrics(), nil)
+	t.Cleanup(loadBalancer.Stop)
+	return createDNSDiscovery(loadBalancer, config, resolver)
+}
+
+// the backends of the pool by url
+func backendsByURL(discovery *DNSDiscovery) map[string]*Backend {
+	backends := make(map[string]*Backend)
+	for _, backend := range discovery.loadBalancer.healthChecker.Backends() {
+		backends[backend.URL] = backend
+	}
+	return backends
+}
+
+func TestDNSDiscoveryA(t *testing.T) {
+	resolver := &stubResolver{hosts: map[string][]string{"user-service": {"10.0.0.1", "10.0.0.2", "127.0.0.1"}}}
+	config := &DiscoveryConfig{Name: "user-service", Type: DiscoveryTypeA, Port: "5000"}
+	// 127.0.0.1:5000 is a static backend the dns also returns
+	discovery := createTestDiscovery(t, "127.0.0.1:5000", config, resolver)
+
+	discovery.refresh()
+	backends := backendsByURL(discovery)
+	for _, url := range []string{"10.0.0.1:5000", "10.0.0.2:5000"} {
+		backend, ok := backends[url]
+		if !ok {
+			t.Fatalf("backend %s was not added", url)
+		}
+		// nothing listens there, so the probe never lets it in
+		if backend.IsAlive() {
+			t.Errorf("backend %s is alive before a successful probe", url)
+		}
+	}
+
+	// a failed lookup keeps the backends
+	resolver.err = errors.New("server misbehaving")
+	discovery.refresh()
+	if len(backendsByURL(discovery)) != 3 {
+		t.Errorf("backends changed on a failed lookup: %v", backendsByURL(discovery))
+	}
+	resolver.err = nil
+
+	resolver.hosts["user-service"] = []string{"10.0.0.2", "::1"}
+	discovery.refresh()
+	backends = backendsByURL(discovery)
+	if backend := backends["10.0.0.1:5000"]; backend != nil && backend.Mode() != ModeDrain {
+		t.Errorf("vanished backend 10.0.0.1:5000 is %s, want drain or removed", backend.Mode())
+	}
+	if _, ok := backends["[::1]:5000"]; !ok {
+		t.Errorf("ipv6 backend [::1]:5000 was not added")
+	}
+	if backend := backends["127.0.0.1:5000"]; backend == nil || backend.Mode() != ModeActive {
+		t.Errorf("static backend 127.0.0.1:5000 was drained by the discovery")
+	}
+
+	// back before its drain ended
+	resolver.hosts["user-service"] = []string{"10.0.0.1", "10.0.0.2"}
+	discovery.refresh()
+	if backend := backendsByURL(discovery)["10.0.0.1:5000"]; backend == nil || backend.Mode() != ModeActive {
+		t.Errorf("backend 10.0.0.1:5000 is not back in rotation")
+	}
+}
+
+// the discovery only puts back in rotation the backends it drained itself
+func TestDNSDiscoveryKeepsOperatorDrains(t *testing.T) {
+	resolver := &stubResolver{hosts: map[string][]string{"user-service": {"10.0.0.1"}}}
+	config := &DiscoveryConfig{Name: "user-service", Type: DiscoveryTypeA, Port: "5000"}
+	discovery := createTestDiscovery(t, "127.0.0.1:5000", config, resolver)
+
+	// a static backend drained by an operator and then returned by the dns
+	if err := discovery.loadBalancer.DrainBackend("127.0.0.1:5000"); err != nil {
+		t.Fatal(err)
+	}
+	resolver.hosts["user-service"] = []string{"10.0.0.1", "127.0.0.1"}
+	discovery.refresh()
+	if backend := backendsByURL(discovery)["127.0.0.1:5000"]; backend == nil || backend.Mode() != ModeDrain {
+		t.Errorf("the discovery re-activated the static backend drained by an operator")
+	}
+
+	// a discovered backend drained by the discovery, then by an operator once back, stays drained
+	resolver.hosts["user-service"] = []string{"127.0.0.1"}
+	discovery.refresh()
+	resolver.hosts["user-service"] = []string{"10.0.0.1", "127.0.0.1"}
+	discovery.refresh()
+	backend := backendsByURL(discovery)["10.0.0.1:5000"]
+	if backend == nil || backend.Mode() != ModeActive {
+		t.Fatalf("backend 10.0.0.1:5000 is not back in rotation")
+	}
+	backend.SetMode(ModeDrain)
+	discovery.refresh()
+	if backend.Mode() != ModeDrain {
+		t.Errorf("the discovery re-activated the backend drained by an operator")
+	}
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	resolver := &stubResolver{
+		hosts: map[string][]string{"user-1": {"10.0.0.1"}, "user-backup": {"10.0.0.9"}},
+		srv: map[string][]*net.SRV{"_http._tcp.user-service": {
+			{Target: "user-1.", Port: 5000, Priority: 0, Weight: 3},
+			{Target: "user-backup.", Port: 5001, Priority: 1, Weight: 0},
+			{Target: "user-gone.", Port: 5000, Priority: 0, Weight: 1},
+		}},
+	}
+	config := &DiscoveryConfig{Name: "_http._tcp.user-service", Type: DiscoveryTypeSRV}
+	discovery := createTestDiscovery(t, "127.0.0.1:5000", config, resolver)
+
+	discovery.refresh()
+	backends := backendsByURL(discovery)
+	if backend := backends["10.0.0.1:5000"]; backend == nil || backend.Weight() != 3 || backend.Priority() != 0 {
+		t.Errorf("backend 10.0.0.1:5000 = %+v, want weight 3 priority 0", backend)
+	}
+	if backend := backends["10.0.0.9:5001"]; backend == nil || backend.Weight() != 1 || backend.Priority() != 1 {
+		t.Errorf("backend 10.0.0.9:5001 = %+v, want weight 1 priority 1", backend)
+	}
+	if len(backends) != 3 {
+		t.Errorf("got %d backends, want the static one and 2 discovered", len(backends))
+	}
+
+	// a new weight in the record updates the backend
+	resolver.srv["_http._tcp.user-service"][0].Weight = 5
+	discovery.refresh()
+	if backend := backendsByURL(discovery)["10.0.0.1:5000"]; backend == nil || backend.Weight() != 5 {
+		t.Errorf("backend 10.0.0.1:5000 = %+v, want weight 5", backend)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// size of the maglev lookup table, it has to be a prime much bigger than the number of backends
+const maglevTableSize = 65537
+
+// hashBalancer maps a client key (the client IP) to a backend so that a client always lands on the same backend
+// it supports three modes:
+// ring: consistent hashing ring with virtual nodes
+// rendezvous: highest random weight hashing, no state needed
+// maglev: the lookup table of google's maglev balancer, evenly spread and O(1) lookups
+// in all three modes only the clients of a backend that goes away are remapped
+type hashBalancer struct {
+	mode string
+	// virtual nodes per unit of weight on the ring
+	virtualNodes int
+
+	// the ring or maglev table is built for one set of healthy backends and rebuilt when that set changes
+	mutex       sync.Mutex
+	builtFor    string
+	ringPoints  []ringPoint
+	maglevTable []*Backend
+}
+
+// ringPoint is a virtual node on the consistent hashing ring
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// create a new hashBalancer for the given mode
+func createHashBalancer(mode string, virtualNodes int) *hashBalancer {
+	return &hashBalancer{
+		mode:         mode,
+		virtualNodes: virtualNodes,
+	}
+}
+
+// pick returns the backend owning the key among the given backends
+func (hasher *hashBalancer) pick(key string, backends []*Backend) *Backend {
+	if hasher.mode == "rendezvous" {
+		return rendezvous(key, backends)
+	}
+
+	hasher.mutex.Lock()
+	defer hasher.mutex.Unlock()
+
+	// only rebuild when the set of backends (or their weights) changed
+	builtFor := backendsSignature(backends)
+	if builtFor != hasher.builtFor {
+		hasher.builtFor = builtFor
+		if hasher.mode == "maglev" {
+			hasher.maglevTable = buildMaglevTable(backends)
+		} else {
+			hasher.ringPoints = buildRing(backends, hasher.virtualNodes)
+		}
+	}
+
+	keyHash := hash64(key)
+	if hasher.mode == "maglev" {
+		return hasher.maglevTable[keyHash%maglevTableSize]
+	}
+
+	// first virtual node clockwise from the key, wrapping around at the end of the ring
+	index := sort.Search(len(hasher.ringPoints), func(i int) bool {
+		return hasher.ringPoints[i].hash >= keyHash
+	})
+	if index == len(hasher.ringPoints) {
+		index = 0
+	}
+	return hasher.ringPoints[index].backend
+}
+
+// buildRing places virtualNodes * weight points per backend on the ring and sorts them
+func buildRing(backends []*Backend, virtualNodes int) []ringPoint {
+	var points []ringPoint
+	for _, backend := range backends {
+		for i := 0; i < virtualNodes*backend.Weight(); i++ {
+			points = append(points, ringPoint{
+				hash:    hash64(backend.URL + "#" + strconv.Itoa(i)),
+				backend: backend,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	return points
+}
+
+// buildMaglevTable fills the lookup table as described in the maglev paper
+// every backend walks its own permutation of the table and takes the first free slot, weight times per round
+func buildMaglevTable(backends []*Backend) []*Backend {
+	offsets := make([]uint64, len(backends))
+	skips := make([]uint64, len(backends))
+	nexts := make([]uint64, len(backends))
+	for i, backend := range backends {
+		offsets[i] = hash64("offset:"+backend.URL) % maglevTableSize
+		skips[i] = hash64("skip:"+backend.URL)%(maglevTableSize-1) + 1
+	}
+
+	table := make([]*Backend, maglevTableSize)
+	filled := 0
+	for {
+		for i, backend := range backends {
+			for turn := 0; turn < backend.Weight(); turn++ {
+				slot := (offsets[i] + nexts[i]*skips[i]) % maglevTableSize
+				for table[slot] != nil {
+					nexts[i]++
+					slot = (offsets[i] + nexts[i]*skips[i]) % maglevTableSize
+				}
+				table[slot] = backend
+				nexts[i]++
+				filled++
+				if filled == maglevTableSize {
+					return table
+				}
+			}
+		}
+	}
+}
+
+// rendezvous gives every backend a score for the key and takes the highest one
+// the score is weighted so a backend gets a share of the keys proportional to its weight
+func rendezvous(key string, backends []*Backend) *Backend {
+	var selectedBackend *Backend
+	bestScore := math.Inf(-1)
+	for _, backend := range backends {
+		// map the hash to ]0,1[ and turn it into a weighted score
+		unit := (float64(hash64(key+"|"+backend.URL)>>11) + 0.5) / (1 << 53)
+		score := -float64(backend.Weight()) / math.Log(unit)
+		if score > bestScore {
+			bestScore = score
+			selectedBackend = backend
+		}
+	}
+	return selectedBackend
+}
+
+// hash64 hashes a string with fnv 64a
+func hash64(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	// fnv alone spreads similar strings (like "backend#1", "backend#2") badly, so we finalize it like murmur3 does
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return sum
+}
+
+// backendsSignature identifies a set of backends with their weights
+func backendsSignature(backends []*Backend) string {
+	var signature strings.Builder
+	for _, backend := range backends {
+		signature.WriteString(backend.URL)
+		signature.WriteByte('=')
+		signature.WriteString(strconv.Itoa(backend.Weight()))
+		signature.WriteByte(',')
+	}
+	return signature.String()
+}
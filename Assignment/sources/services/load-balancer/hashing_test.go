@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// client keys spread over a /16 like real client IPs
+func testKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+	}
+	return keys
+}
+
+// when a backend goes away only its clients move, and a client keeps its backend across calls
+func TestHashingRemapStability(t *testing.T) {
+	keys := testKeys(10000)
+	for _, mode := range []string{"ring", "rendezvous", "maglev"} {
+		hasher := createHashBalancer(mode, 100)
+		backends := createTestBackends(t, "user-1:5000,user-2:5000,user-3:5000,user-4:5000")
+
+		before := make(map[string]string, len(keys))
+		for _, key := range keys {
+			before[key] = hasher.pick(key, backends).URL
+			if again := hasher.pick(key, backends).URL; again != before[key] {
+				t.Fatalf("%s: key %s moved from %s to %s without a change", mode, key, before[key], again)
+			}
+		}
+
+		// user-3 goes down
+		remaining := []*Backend{backends[0], backends[1], backends[3]}
+		moved := 0
+		for _, key := range keys {
+			after := hasher.pick(key, remaining).URL
+			if after == "user-3:5000" {
+				t.Fatalf("%s: key %s still goes to the removed backend", mode, key)
+			}
+			if before[key] != "user-3:5000" && after != before[key] {
+				moved++
+			}
+		}
+		// ring and rendezvous never move another client, maglev moves a few percents at most
+		limit := 0
+		if mode == "maglev" {
+			limit = len(keys) * 3 / 100
+		}
+		if moved > limit {
+			t.Errorf("%s: %d clients of the remaining backends moved, want at most %d", mode, moved, limit)
+		}
+
+		// user-3 comes back, every client goes back where it was
+		for _, key := range keys {
+			if after := hasher.pick(key, backends).URL; after != before[key] {
+				t.Errorf("%s: key %s went to %s instead of %s once the backend was back", mode, key, after, before[key])
+				break
+			}
+		}
+	}
+}
+
+// a backend gets a share of the clients proportional to its weight
+func TestHashingWeights(t *testing.T) {
+	keys := testKeys(20000)
+	for _, mode := range []string{"ring", "rendezvous", "maglev"} {
+		hasher := createHashBalancer(mode, 100)
+		backends := createTestBackends(t, "user-1:5000=3,user-2:5000=1")
+
+		counts := make(map[string]int)
+		for _, key := range keys {
+			counts[hasher.pick(key, backends).URL]++
+		}
+		share := float64(counts["user-1:5000"]) / float64(len(keys))
+		if math.Abs(share-0.75) > 0.05 {
+			t.Errorf("%s: the backend of weight 3 out of 4 got %.2f of the clients, want 0.75", mode, share)
+		}
+	}
+}
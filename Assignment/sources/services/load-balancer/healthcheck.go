@@ -1,32 +1,163 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// maximum number of bytes of a health check response body we look at for the body match
+const maxHealthCheckBody = 64 * 1024
+
 // represents a backend service
 // Backend holds the state of a single backend server
 type Backend struct {
 	URL   string
 	Alive bool
+	// relative share of the traffic for the weighted algorithms (1 by default)
+	weight int
+	// priority level, the backends of a higher number only get traffic when the levels before them are unhealthy
+	priority int
+	// the active check used to probe this backend
+	healthCheck *HealthCheckConfig
+	// probed is false until the first probe decided the initial state
+	probed bool
+	// added at runtime (admin api, reload), its first UP starts a slow start like a recovery does
+	addedAtRuntime bool
+	// when the backend last became healthy, zero if it was up since the start of the balancer (see slowstart.go)
+	upSince time.Time
+	// consecutive probe results, compared against the rise and fall thresholds
+	successes int
+	failures  int
+	// passive state from the live traffic (see outlier.go)
+	outlier outlierState
+	// average connect time and time to first byte of the live traffic (see latency.go)
+	latency latencyState
+	// number of connections currently forwarded to this backend, used by leastconn and p2c
+	activeConnections atomic.Int64
+	// administrative mode set through the admin api: active, drain or maintenance
+	mode string
 	// RWMutex allows many readers (GetHealthyBackends) or one writer (SetAlive)
 	//ensures no read / write at the same time
 	mutex sync.RWMutex
 }
 
+// HealthCheckConfig describes the active check run against a backend
+// Type is "tcp" (only connect), "http" (GET on Path and validate the answer),
+// "udp" (send a datagram and wait for an answer or a port unreachable) or "none" (always healthy)
+type HealthCheckConfig struct {
+	Type string
+	Path string
+	// accepted status codes for the http check, e.g. 200-299
+	ExpectedStatus []StatusRange
+	// optional substring the http response body (or the udp answer) has to contain
+	ExpectedBody string
+	// datagram sent by the udp check
+	Send []byte
+	// time between two rounds of checks, a random delay up to Jitter is added to spread the probes
+	Interval time.Duration
+	Jitter   time.Duration
+	// time after which a probe counts as failed
+	Timeout time.Duration
+	// consecutive successes needed to mark a DOWN backend UP (Rise)
+	// and consecutive failures needed to mark an UP backend DOWN (Fall)
+	Rise int
+	Fall int
+}
+
+// BackendHealthCheck overrides the health check of the pool for one backend, the fields left empty keep the pool setting
+// e.g. {"type": "http", "path": "/ready", "status": "200", "body": "ok"} for a replica with its own readiness endpoint
+type BackendHealthCheck struct {
+	Type string `json:"type,omitempty"`
+	Path string `json:"path,omitempty"`
+	// accepted status codes like "200-299,301"
+	Status string `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+// apply returns the check of a backend: the check of the pool with the fields set by the override
+// a nil override is the check of the pool
+func (override *BackendHealthCheck) apply(healthCheck *HealthCheckConfig) (*HealthCheckConfig, error) {
+	if override == nil {
+		return healthCheck, nil
+	}
+	resolved := *healthCheck
+	switch override.Type {
+	case "":
+	case "tcp", "http", "udp", "none":
+		resolved.Type = override.Type
+	default:
+		return nil, fmt.Errorf("invalid health check type %q: must be tcp, http, udp or none", override.Type)
+	}
+	if override.Path != "" {
+		resolved.Path = override.Path
+		if !strings.HasPrefix(resolved.Path, "/") {
+			resolved.Path = "/" + resolved.Path
+		}
+	}
+	if override.Status != "" {
+		expectedStatus, err := parseStatusRanges(override.Status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check status: %w", err)
+		}
+		resolved.ExpectedStatus = expectedStatus
+	}
+	if override.Body != "" {
+		resolved.ExpectedBody = override.Body
+	}
+	return &resolved, nil
+}
+
+// StatusRange is an inclusive range of http status codes
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// administrative modes of a backend
+// drain: no new connections but the running ones continue and the backend is still checked
+// maintenance: no new connections and no health checks until it is enabled again
+const (
+	ModeActive      = "active"
+	ModeDrain       = "drain"
+	ModeMaintenance = "maintenance"
+)
+
 // represents an instance of a Healthchecker
 // it stores all the Backend services
-// a ticker to limit the healthcheck rate
+// an interval (plus jitter) to limit the healthcheck rate
+// a stop channel to end the check loop
 // a wait group to wait for goroutines to end
-// a timeout to represent a dead backend
 type HealthChecker struct {
-	backends     []*Backend
-	ticker       *time.Ticker
-	wg           sync.WaitGroup
-	checkTimeout time.Duration
+	backends []*Backend
+	// backends can be added and removed at runtime (admin api), this protects the slice
+	backendsMutex sync.RWMutex
+	// active check used for the backends added at runtime
+	healthCheck *HealthCheckConfig
+	interval    time.Duration
+	jitter      time.Duration
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	// passive outlier detection settings, nil disables it
+	outlierConfig *OutlierConfig
+	// healthy fraction below which a priority level spills over to the next one
+	priorityThreshold float64
+	// last priority level serving traffic, only used to log when the traffic moves between levels
+	priorityLevel atomic.Int64
+	metrics       *MetricsHandler
+	// client used for the http checks, it never follows redirects so 3xx can be matched as a status
+	httpClient *http.Client
 }
 
 // set a backend to alive or dead depending on the boolean in a threadsafe manner
@@ -36,6 +167,42 @@ func (backend *Backend) SetAlive(alive bool) {
 	backend.Alive = alive
 }
 
+// record the result of a probe and apply the rise and fall thresholds
+// the very first probe decides the state directly, afterwards the state only flips after
+// Rise consecutive successes or Fall consecutive failures
+// returns true if the state of the backend changed
+func (backend *Backend) recordProbe(healthy bool) bool {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if !backend.probed {
+		backend.probed = true
+		backend.Alive = healthy
+		if healthy && backend.addedAtRuntime {
+			backend.upSince = time.Now()
+		}
+		return true
+	}
+
+	if healthy {
+		backend.successes++
+		backend.failures = 0
+		if !backend.Alive && backend.successes >= backend.healthCheck.Rise {
+			backend.Alive = true
+			backend.upSince = time.Now()
+			return true
+		}
+	} else {
+		backend.failures++
+		backend.successes = 0
+		if backend.Alive && backend.failures >= backend.healthCheck.Fall {
+			backend.Alive = false
+			return true
+		}
+	}
+	return false
+}
+
 // check if a backend is alive or dead in a threadsafe manner
 func (backend *Backend) IsAlive() bool {
 	backend.mutex.RLock()
@@ -43,30 +210,103 @@ func (backend *Backend) IsAlive() bool {
 	return backend.Alive
 }
 
-// create a Healthchecker for a given number (URLs) of backends
-func createHealthChecker(backendURLs []string) *HealthChecker {
-	backends := make([]*Backend, len(backendURLs))
-	for i, url := range backendURLs {
-		backends[i] = &Backend{
-			URL:   url,
-			Alive: true, // Start optimistically
-		}
+// set the administrative mode of a backend in a threadsafe manner
+func (backend *Backend) SetMode(mode string) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.mode = mode
+}
+
+// return the administrative mode of a backend in a threadsafe manner
+func (backend *Backend) Mode() string {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+	return backend.mode
+}
+
+// return the weight of a backend in a threadsafe manner, a reload can change it
+func (backend *Backend) Weight() int {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+	return backend.weight
+}
+
+// return the priority level of a backend in a threadsafe manner, a reload can change it
+func (backend *Backend) Priority() int {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+	return backend.priority
+}
+
+// return the active check of a backend in a threadsafe manner, a reload can change it
+func (backend *Backend) activeCheck() *HealthCheckConfig {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+	return backend.healthCheck
+}
+
+// create a Healthchecker for a given list of backends
+// every backend is probed with the given active check
+// backends start DOWN and only receive traffic once the first probe succeeded
+func createHealthChecker(backendConfigs []BackendConfig, healthCheck *HealthCheckConfig, outlierConfig *OutlierConfig, priorityThreshold float64) *HealthChecker {
+	backends := make([]*Backend, len(backendConfigs))
+	for i, backendConfig := range backendConfigs {
+		backends[i] = createBackend(backendConfig, healthCheck)
 	}
 	return &HealthChecker{
-		backends:     backends,
-		ticker:       time.NewTicker(10 * time.Second), // Check every 10 seconds
-		checkTimeout: 2 * time.Second,
+		backends:          backends,
+		healthCheck:       healthCheck,
+		interval:          healthCheck.Interval,
+		jitter:            healthCheck.Jitter,
+		stop:              make(chan struct{}),
+		outlierConfig:     outlierConfig,
+		priorityThreshold: priorityThreshold,
+		httpClient: &http.Client{
+			CheckRedirect: func(request *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// create a backend that is DOWN until its first probe
+// it is checked with the check of the pool, or with its own override of it
+func createBackend(backendConfig BackendConfig, healthCheck *HealthCheckConfig) *Backend {
+	// the override is validated when the backend is configured (loadConfig, admin api), an invalid one is logged
+	resolved, err := backendConfig.HealthCheck.apply(healthCheck)
+	if err != nil {
+		log.Printf("Health check: invalid health check of backend %s, using the one of the pool: %v", backendConfig.URL, err)
+	} else {
+		healthCheck = resolved
+	}
+	return &Backend{
+		URL:         backendConfig.URL,
+		Alive:       false,
+		weight:      backendConfig.Weight,
+		priority:    backendConfig.Priority,
+		healthCheck: healthCheck,
+		mode:        ModeActive,
 	}
 }
 
-// Start begins the periodic health checks in a new goroutine
+// Start runs a first round of checks right away so the initial state is known before traffic arrives
+// and then begins the periodic health checks in a new goroutine
 func (healthChecker *HealthChecker) Start() {
 	log.Println("Starting health check service...")
+	healthChecker.runHealthChecks()
+
 	healthChecker.wg.Add(1)
 	go func() {
 		defer healthChecker.wg.Done()
-		for range healthChecker.ticker.C {
-			healthChecker.runHealthChecks()
+		for {
+			timer := time.NewTimer(healthChecker.nextDelay())
+			select {
+			case <-healthChecker.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				healthChecker.runHealthChecks()
+			}
 		}
 	}()
 }
@@ -74,49 +314,265 @@ func (healthChecker *HealthChecker) Start() {
 // Stop terminates the health check goroutine
 func (healthChecker *HealthChecker) Stop() {
 	log.Println("Stopping health check service...")
-	healthChecker.ticker.Stop()
+	close(healthChecker.stop)
 	healthChecker.wg.Wait() // Wait for the goroutine to finish
 }
 
+// nextDelay returns the interval plus a random jitter so the balancers do not probe in lockstep
+func (healthChecker *HealthChecker) nextDelay() time.Duration {
+	if healthChecker.jitter <= 0 {
+		return healthChecker.interval
+	}
+	return healthChecker.interval + rand.N(healthChecker.jitter)
+}
+
 // runHealthChecks pings all backends concurrently
+// backends in maintenance are not checked
 func (healthChecker *HealthChecker) runHealthChecks() {
 	var wg sync.WaitGroup
-	for _, backend := range healthChecker.backends {
+	for _, backend := range healthChecker.Backends() {
+		if backend.Mode() == ModeMaintenance {
+			continue
+		}
 		wg.Add(1)
 		go func(backend *Backend) {
 			defer wg.Done()
-			// Ping the backend with a 2-second timeout
-			//first implementation of a raw tcp healthcheck: not smart enough
-			//conn, err := net.DialTimeout("tcp", backend.URL, 2*time.Second)
-
-			//more intelligent healthcheck
-			conn, err := net.DialTimeout("tcp", backend.URL, healthChecker.checkTimeout)
-			wasAlive := backend.IsAlive()
-
-			if err != nil {
-				backend.SetAlive(false)
-				if wasAlive { // Only log if the state changes
-					log.Printf("Health check: Backend %s is DOWN", backend.URL)
-				}
-			} else {
-				backend.SetAlive(true)
-				if !wasAlive { // Only log if the state changes
-					log.Printf("Health check: Backend %s is UP", backend.URL)
-				}
-				conn.Close()
-			}
+			healthChecker.checkBackend(backend)
 		}(backend)
 	}
 	wg.Wait()
 }
 
-// GetHealthyBackends returns a slice of URLs for all backends that are currently alive
-func (healthChecker *HealthChecker) GetHealthyBackends() []string {
-	var healthy []string
+// checkBackend probes a single backend and updates its state
+func (healthChecker *HealthChecker) checkBackend(backend *Backend) {
+	err := healthChecker.probe(backend)
+
+	// Only log if the state changes
+	if backend.recordProbe(err == nil) {
+		if err != nil {
+			log.Printf("Health check: Backend %s is DOWN (%v)", backend.URL, err)
+			healthChecker.metrics.saveStateChange(backend.URL, "down")
+		} else {
+			log.Printf("Health check: Backend %s is UP", backend.URL)
+			healthChecker.metrics.saveStateChange(backend.URL, "up")
+		}
+	}
+}
+
+// probe runs the active check configured for a backend and returns why it failed, nil if the backend is healthy
+func (healthChecker *HealthChecker) probe(backend *Backend) error {
+	healthCheck := backend.activeCheck()
+	switch healthCheck.Type {
+	case "http":
+		return healthChecker.probeHTTP(backend, healthCheck)
+	case "udp":
+		return healthChecker.probeUDP(backend, healthCheck)
+	case "none":
+		return nil
+	}
+	return healthChecker.probeTCP(backend, healthCheck)
+}
+
+// probeTCP only checks that the backend accepts a tcp connection
+func (healthChecker *HealthChecker) probeTCP(backend *Backend, healthCheck *HealthCheckConfig) error {
+	//first implementation of a raw tcp healthcheck: not smart enough
+	//conn, err := net.DialTimeout("tcp", backend.URL, 2*time.Second)
+
+	//more intelligent healthcheck
+	conn, err := net.DialTimeout("tcp", backend.URL, healthCheck.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// probeUDP sends the configured datagram and waits for the answer
+// a udp service does not have to answer anything, so without an expected body a backend that stays silent
+// is healthy as long as no port unreachable comes back within the timeout
+func (healthChecker *HealthChecker) probeUDP(backend *Backend, healthCheck *HealthCheckConfig) error {
+	conn, err := net.DialTimeout("udp", backend.URL, healthCheck.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(healthCheck.Timeout))
+	if _, err := conn.Write(healthCheck.Send); err != nil {
+		return err
+	}
+	buffer := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buffer)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && healthCheck.ExpectedBody == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(buffer[:n]), healthCheck.ExpectedBody) {
+		return errors.New("answer does not contain the expected content")
+	}
+	return nil
+}
+
+// probeHTTP sends a GET on the configured path and validates the status code and optionally the body
+// this catches backends that still accept connections but can not serve requests (e.g. their database is gone)
+func (healthChecker *HealthChecker) probeHTTP(backend *Backend, healthCheck *HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheck.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+backend.URL+healthCheck.Path, nil)
+	if err != nil {
+		return err
+	}
+	response, err := healthChecker.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	// the rest of the body is read so the connection goes back to the pool of the client for the next probe
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(response.Body, maxHealthCheckBody))
+		response.Body.Close()
+	}()
+
+	if !healthCheck.statusAccepted(response.StatusCode) {
+		return fmt.Errorf("unexpected status %d on %s", response.StatusCode, healthCheck.Path)
+	}
+
+	if healthCheck.ExpectedBody != "" {
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxHealthCheckBody))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), healthCheck.ExpectedBody) {
+			return errors.New("response body does not contain the expected content")
+		}
+	}
+	return nil
+}
+
+// check if a status code is in one of the accepted ranges
+func (healthCheck *HealthCheckConfig) statusAccepted(statusCode int) bool {
+	for _, statusRange := range healthCheck.ExpectedStatus {
+		if statusCode >= statusRange.Min && statusCode <= statusRange.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// parse a list of status codes and ranges like "200-299,301" into StatusRanges
+func parseStatusRanges(value string) ([]StatusRange, error) {
+	var ranges []StatusRange
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		lowCode, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", part)
+		}
+		highCode, err := strconv.Atoi(strings.TrimSpace(high))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", part)
+		}
+		if lowCode < 100 || highCode > 599 || lowCode > highCode {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+		ranges = append(ranges, StatusRange{Min: lowCode, Max: highCode})
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("no status codes given")
+	}
+	return ranges, nil
+}
+
+// GetHealthyBackends returns a slice of the active backends that are currently alive and not ejected
+// and belong to the priority levels serving the traffic (see priority.go)
+// if the outlier detection ejected every alive backend we ignore the ejections rather than dropping all traffic
+func (healthChecker *HealthChecker) GetHealthyBackends() []*Backend {
+	return healthChecker.priorityBackends(healthChecker.Backends())
+}
+
+// getBackend returns the backend with the given URL, nil if it is unknown
+func (healthChecker *HealthChecker) getBackend(backendURL string) *Backend {
+	healthChecker.backendsMutex.RLock()
+	defer healthChecker.backendsMutex.RUnlock()
+	for _, backend := range healthChecker.backends {
+		if backend.URL == backendURL {
+			return backend
+		}
+	}
+	return nil
+}
+
+// Backends returns a snapshot of all the backends, whatever their state
+func (healthChecker *HealthChecker) Backends() []*Backend {
+	healthChecker.backendsMutex.RLock()
+	defer healthChecker.backendsMutex.RUnlock()
+	return slices.Clone(healthChecker.backends)
+}
+
+// AddBackend adds a backend at runtime, it only receives traffic once its first probe succeeded
+func (healthChecker *HealthChecker) AddBackend(backendConfig BackendConfig) (*Backend, error) {
+	healthChecker.backendsMutex.Lock()
 	for _, backend := range healthChecker.backends {
-		if backend.IsAlive() {
-			healthy = append(healthy, backend.URL)
+		if backend.URL == backendConfig.URL {
+			healthChecker.backendsMutex.Unlock()
+			return nil, fmt.Errorf("backend %s already exists", backendConfig.URL)
+		}
+	}
+	backend := createBackend(backendConfig, healthChecker.healthCheck)
+	backend.addedAtRuntime = true
+	healthChecker.backends = append(healthChecker.backends, backend)
+	healthChecker.backendsMutex.Unlock()
+
+	log.Printf("Health check: Backend %s added", backend.URL)
+	// probe right away instead of waiting for the next round
+	go healthChecker.checkBackend(backend)
+	return backend, nil
+}
+
+// UpdateBackend gives a running backend a new weight, priority and health check override
+// the backend is changed in place, so its health state and its count of active connections are kept
+func (healthChecker *HealthChecker) UpdateBackend(backendConfig BackendConfig) (*Backend, error) {
+	backend := healthChecker.getBackend(backendConfig.URL)
+	if backend == nil {
+		return nil, fmt.Errorf("backend %s not found", backendConfig.URL)
+	}
+	healthCheck, err := backendConfig.HealthCheck.apply(healthChecker.healthCheck)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.mutex.Lock()
+	oldWeight, oldPriority := backend.weight, backend.priority
+	backend.weight = backendConfig.Weight
+	backend.priority = backendConfig.Priority
+	backend.healthCheck = healthCheck
+	backend.mutex.Unlock()
+
+	log.Printf("Health check: Backend %s updated (weight %d -> %d, priority %d -> %d)", backend.URL, oldWeight, backendConfig.Weight, oldPriority, backendConfig.Priority)
+	return backend, nil
+}
+
+// RemoveBackend removes a backend at runtime
+// it gets no new connections, the ones already forwarded to it keep running until they end
+func (healthChecker *HealthChecker) RemoveBackend(backendURL string) (*Backend, error) {
+	healthChecker.backendsMutex.Lock()
+	defer healthChecker.backendsMutex.Unlock()
+	for i, backend := range healthChecker.backends {
+		if backend.URL == backendURL {
+			healthChecker.backends = slices.Delete(healthChecker.backends, i, i+1)
+			log.Printf("Health check: Backend %s removed", backendURL)
+			return backend, nil
 		}
 	}
-	return healthy
+	return nil, fmt.Errorf("backend %s not found", backendURL)
 }
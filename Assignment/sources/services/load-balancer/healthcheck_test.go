@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []StatusRange
+		wantErr bool
+	}{
+		{value: "200", want: []StatusRange{{200, 200}}},
+		{value: "200-299", want: []StatusRange{{200, 299}}},
+		{value: " 200-299 , 301,", want: []StatusRange{{200, 299}, {301, 301}}},
+		{value: "200 - 204", want: []StatusRange{{200, 204}}},
+		{value: "", wantErr: true},
+		{value: ",", wantErr: true},
+		{value: "ok", wantErr: true},
+		{value: "200-", wantErr: true},
+		{value: "299-200", wantErr: true},
+		{value: "99", wantErr: true},
+		{value: "200-600", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseStatusRanges(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseStatusRanges(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseStatusRanges(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestStatusAccepted(t *testing.T) {
+	healthCheck := &HealthCheckConfig{ExpectedStatus: []StatusRange{{200, 299}, {301, 301}}}
+	for statusCode, want := range map[int]bool{199: false, 200: true, 299: true, 300: false, 301: true, 302: false, 503: false} {
+		if got := healthCheck.statusAccepted(statusCode); got != want {
+			t.Errorf("statusAccepted(%d) = %v, want %v", statusCode, got, want)
+		}
+	}
+}
+
+func TestBackendHealthCheckApply(t *testing.T) {
+	pool := &HealthCheckConfig{Type: "tcp", Path: "/healthz", ExpectedStatus: []StatusRange{{200, 399}}, Timeout: time.Second, Rise: 2, Fall: 3}
+
+	var none *BackendHealthCheck
+	if got, err := none.apply(pool); err != nil || got != pool {
+		t.Errorf("nil override = %+v, %v, want the check of the pool", got, err)
+	}
+
+	got, err := (&BackendHealthCheck{Type: "http", Path: "ready", Status: "200", Body: "ok"}).apply(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &HealthCheckConfig{Type: "http", Path: "/ready", ExpectedStatus: []StatusRange{{200, 200}}, ExpectedBody: "ok", Timeout: time.Second, Rise: 2, Fall: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("override = %+v, want %+v", got, want)
+	}
+	if pool.Type != "tcp" || pool.Path != "/healthz" {
+		t.Errorf("the override changed the check of the pool: %+v", pool)
+	}
+
+	for _, invalid := range []*BackendHealthCheck{{Type: "icmp"}, {Status: "2xx"}} {
+		if _, err := invalid.apply(pool); err == nil {
+			t.Errorf("override %+v was accepted", invalid)
+		}
+	}
+}
+
+func TestLoadBackendHealthChecks(t *testing.T) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{
+		"LB_BACKENDS":       "user-1:5000,user-2:5000",
+		"LB_HEALTH_TYPE":    "http",
+		"LB_BACKEND_HEALTH": `{"user-2:5000": {"path": "/ready", "status": "204"}}`,
+	})
+	if config.Backends[0].HealthCheck != nil {
+		t.Errorf("user-1:5000 got an override: %+v", config.Backends[0].HealthCheck)
+	}
+	if override := config.Backends[1].HealthCheck; override == nil || override.Path != "/ready" || override.Status != "204" {
+		t.Errorf("user-2:5000 override = %+v", override)
+	}
+
+	for _, invalid := range []string{
+		`{"user-3:5000": {"path": "/ready"}}`,
+		`{"user-1:5000": {"status": "ok"}}`,
+		`{"user-1:5000": {"timeout": "1s"}}`,
+		`[]`,
+	} {
+		values := map[string]string{"LB_BACKENDS": "user-1:5000", "LB_BACKEND_HEALTH": invalid}
+		if _, err := loadConfig(func(key string) string { return values[key] }); err == nil {
+			t.Errorf("LB_BACKEND_HEALTH %s was accepted", invalid)
+		}
+	}
+}
+
+// the http probe of a backend uses its own path and body match, and reuses its connection
+func TestProbeHTTP(t *testing.T) {
+	var connections atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/healthz":
+			writer.Write([]byte(strings.Repeat("x", 8192)))
+		case "/ready":
+			writer.Write([]byte("database ok"))
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.Config.ConnState = func(connection net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	url := strings.TrimPrefix(server.URL, "http://")
+
+	pool := &HealthCheckConfig{Type: "http", Path: "/healthz", ExpectedStatus: []StatusRange{{200, 399}}, Timeout: time.Second, Rise: 1, Fall: 1}
+	healthChecker := createHealthChecker(nil, pool, &OutlierConfig{}, 0)
+
+	tests := []struct {
+		override *BackendHealthCheck
+		healthy  bool
+	}{
+		{override: nil, healthy: true},
+		{override: &BackendHealthCheck{Path: "/ready", Body: "database ok"}, healthy: true},
+		{override: &BackendHealthCheck{Path: "/ready", Body: "database down"}, healthy: false},
+		{override: &BackendHealthCheck{Path: "/missing"}, healthy: false},
+		{override: &BackendHealthCheck{Path: "/missing", Status: "404"}, healthy: true},
+		// an invalid override falls back to the check of the pool
+		{override: &BackendHealthCheck{Type: "grpc", Path: "/missing"}, healthy: true},
+	}
+	for _, test := range tests {
+		backend := createBackend(BackendConfig{URL: url, Weight: 1, HealthCheck: test.override}, pool)
+		err := healthChecker.probe(backend)
+		if (err == nil) != test.healthy {
+			t.Errorf("probe with override %+v = %v, want healthy %v", test.override, err, test.healthy)
+		}
+	}
+
+	// the unread bodies are drained, so every probe went over the same connection
+	if got := connections.Load(); got != 1 {
+		t.Errorf("the probes opened %d connections, want 1", got)
+	}
+}
+
+func TestRecordProbe(t *testing.T) {
+	healthCheck := &HealthCheckConfig{Rise: 2, Fall: 3}
+	// every step is a probe result and the state the backend is in after it
+	tests := []struct {
+		name  string
+		steps []bool
+		want  []bool
+	}{
+		{name: "first probe decides", steps: []bool{true}, want: []bool{true}},
+		{name: "first probe down", steps: []bool{false}, want: []bool{false}},
+		{name: "fall after 3 failures", steps: []bool{true, false, false, false}, want: []bool{true, true, true, false}},
+		{name: "a success resets the failures", steps: []bool{true, false, false, true, false, false}, want: []bool{true, true, true, true, true, true}},
+		{name: "rise after 2 successes", steps: []bool{false, true, true}, want: []bool{false, false, true}},
+		{name: "flapping stays down", steps: []bool{false, true, false, true, false}, want: []bool{false, false, false, false, false}},
+	}
+	for _, test := range tests {
+		backend := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, healthCheck)
+		if backend.IsAlive() {
+			t.Fatalf("%s: a new backend is alive before its first probe", test.name)
+		}
+		for i, healthy := range test.steps {
+			backend.recordProbe(healthy)
+			if backend.IsAlive() != test.want[i] {
+				t.Errorf("%s: after probe %d alive = %v, want %v", test.name, i+1, backend.IsAlive(), test.want[i])
+			}
+		}
+	}
+}
+
+// a backend added at runtime starts its slow start on its first UP, the ones of the start of the balancer do not
+func TestRecordProbeUpSince(t *testing.T) {
+	healthCheck := &HealthCheckConfig{Rise: 1, Fall: 1}
+	initial := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, healthCheck)
+	initial.recordProbe(true)
+	if !initial.upSince.IsZero() {
+		t.Errorf("a backend up at the start got upSince %v", initial.upSince)
+	}
+
+	added := createBackend(BackendConfig{URL: "user-2:5000", Weight: 1}, healthCheck)
+	added.addedAtRuntime = true
+	added.recordProbe(true)
+	if added.upSince.IsZero() {
+		t.Errorf("a backend added at runtime did not start its slow start")
+	}
+
+	initial.recordProbe(false)
+	initial.recordProbe(true)
+	if initial.upSince.IsZero() {
+		t.Errorf("a recovered backend did not start its slow start")
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// modes of a listener (LB_MODE)
+const (
+	// every connection is forwarded as is to one backend
+	ListenerModeTCP = "tcp"
+	// every http request is forwarded on its own
+	ListenerModeHTTP = "http"
+	// every client address is a flow of datagrams forwarded to one backend
+	ListenerModeUDP = "udp"
+)
+
+// HTTPProxy is the layer 7 mode of a listener (LB_MODE=http)
+// the connections accepted by the Server are handed to an http.Server and every request is balanced on its own,
+// so a keep-alive client spreads its requests over all the backends instead of sticking to one
+type HTTPProxy struct {
+	httpServer *http.Server
+	listener   *connListener
+	proxy      *httputil.ReverseProxy
+	// pins the requests of a user to a backend, nil when disabled
+	affinity *AffinityConfig
+	// per request bandwidth limits of the listener, the shared ones come from the pool
+	bandwidth *BandwidthConfig
+}
+
+// httpAttempt is the state of one try to forward a request to a backend, shared with the ReverseProxy hooks
+type httpAttempt struct {
+	backend *Backend
+	// the affinity cookie has to be set to this backend in the response
+	setCookie bool
+	// a dial failure is retried on another backend, nothing has been sent yet
+	canRetry   bool
+	dialFailed bool
+	err        error
+	statusCode int
+	// dial time of a new connection to the backend, for the access log
+	// the transport dials in its own goroutine which can outlive the attempt
+	connectTime atomic.Int64
+}
+
+// context keys of the pool of a connection and the attempt of a request
+type poolContextKey struct{}
+type attemptContextKey struct{}
+
+// create the http proxy of a listener and start serving the connections handed to it
+func createHTTPProxy(config *Config) *HTTPProxy {
+	httpProxy := &HTTPProxy{
+		listener:  createConnListener(),
+		affinity:  config.Affinity,
+		bandwidth: config.Bandwidth,
+	}
+
+	dialer := createDialer(config)
+	httpProxy.proxy = &httputil.ReverseProxy{
+		Rewrite:        httpProxy.rewrite,
+		ModifyResponse: httpProxy.modifyResponse,
+		ErrorHandler:   httpProxy.handleError,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	httpProxy.httpServer = &http.Server{
+		Handler:           httpProxy,
+		ReadHeaderTimeout: 30 * time.Second,
+		// time a keep-alive connection may wait for its next request, 0 keeps it open
+		IdleTimeout: config.IdleTimeout,
+		// the requests of a connection are balanced over the pool the connection was routed to
+		ConnContext: func(ctx context.Context, connection net.Conn) context.Context {
+			return context.WithValue(ctx, poolContextKey{}, httpProxy.listener.pool(connection))
+		},
+	}
+	go func() {
+		if err := httpProxy.httpServer.Serve(httpProxy.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP proxy failed: %v", err)
+		}
+	}()
+	return httpProxy
+}
+
+// serve hands an accepted connection to the http server, its requests go to the given pool
+func (httpProxy *HTTPProxy) serve(connection net.Conn, loadBalancer *LoadBalancer) {
+	httpProxy.listener.push(connection, loadBalancer)
+}
+
+// ServeHTTP balances one request
+func (httpProxy *HTTPProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	loadBalancer := request.Context().Value(poolContextKey{}).(*LoadBalancer)
+	clientIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		clientIP = request.RemoteAddr
+	}
+
+	record := &accessRecord{
+		Time:      time.Now(),
+		Protocol:  ListenerModeHTTP,
+		Client:    request.RemoteAddr,
+		Algorithm: loadBalancer.Algorithm(),
+		Method:    request.Method,
+		Path:      request.URL.Path,
+	}
+	if localAddr, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		record.Frontend = localAddr.String()
+	}
+	counter := &countingResponseWriter{ResponseWriter: writer}
+	writer = counter
+	body := &countingBody{ReadCloser: request.Body}
+	defer func() {
+		record.Status = counter.status
+		record.BytesIn = body.read.Load()
+		record.BytesOut = counter.written
+		loadBalancer.accessLog.write(record)
+	}()
+
+	tried := make(map[string]bool)
+	attempts := loadBalancer.config.ConnectAttempts
+	// the transport closes the body of a failed request, so only requests without body can be sent again
+	if request.Body != http.NoBody {
+		attempts = 1
+		request.Body = body
+	}
+	for attempt := 1; attempt <= attempts; attempt++ {
+		record.Retries = attempt - 1
+		backend, setCookie := httpProxy.affinity.selectBackend(loadBalancer, request, clientIP, tried)
+		if backend == nil {
+			http.Error(writer, "no healthy backend available", http.StatusServiceUnavailable)
+			record.Termination = TerminationNoBackend
+			return
+		}
+		record.Backend = backend.URL
+
+		state := &httpAttempt{backend: backend, setCookie: setCookie, canRetry: attempt < attempts}
+		// the transport reuses its connections to the backends, connect_ms stays 0 for a request sent on an idle one
+		// the connect time and the time from getting a connection to the first byte of the answer feed leastresponse
+		var connectStart, gotConn time.Time
+		trace := &httptrace.ClientTrace{
+			ConnectStart: func(string, string) { connectStart = time.Now() },
+			ConnectDone: func(_, _ string, err error) {
+				if err == nil {
+					connectTime := time.Since(connectStart)
+					state.connectTime.Store(int64(connectTime))
+					backend.observeConnect(connectTime)
+				}
+			},
+			GotConn:              func(httptrace.GotConnInfo) { gotConn = time.Now() },
+			GotFirstResponseByte: func() { backend.observeFirstByte(time.Since(gotConn)) },
+		}
+		ctx := httptrace.WithClientTrace(context.WithValue(request.Context(), attemptContextKey{}, state), trace)
+		outRequest := request.WithContext(ctx)
+
+		// the bandwidth limits and the byte counters of the backend, like for a tcp connection
+		upLimiters, downLimiters, releaseLimiters := loadBalancer.bandwidth.acquire(clientIP, backend.URL, httpProxy.bandwidth)
+		if request.Body != http.NoBody {
+			outRequest.Body = &limitedBody{
+				Reader: createRateLimitedReader(ctx, loadBalancer.metrics.createCountingReader(request.Body, backend.URL, "in"), upLimiters),
+				Closer: request.Body,
+			}
+		}
+		limitedWriter := &limitedResponseWriter{
+			ResponseWriter: writer,
+			ctx:            ctx,
+			limiters:       downLimiters,
+			counter:        loadBalancer.metrics.bytesTotal.WithLabelValues(backend.URL, "out"),
+		}
+
+		startTime := time.Now()
+		loadBalancer.increment(backend)
+		httpProxy.proxy.ServeHTTP(limitedWriter, outRequest)
+		loadBalancer.decrement(backend)
+		releaseLimiters()
+		loadBalancer.metrics.connectionDuration.WithLabelValues(backend.URL).Observe(time.Since(startTime).Seconds())
+		record.ConnectMs = milliseconds(time.Duration(state.connectTime.Load()))
+
+		if state.dialFailed {
+			log.Printf("Failed to connect to backend %s (attempt %d/%d): %v", backend.URL, attempt, attempts, state.err)
+			loadBalancer.metrics.dialFailures.WithLabelValues(backend.URL).Inc()
+			loadBalancer.healthChecker.ReportFailure(backend.URL, "dial failed")
+			if state.canRetry {
+				tried[backend.URL] = true
+				continue
+			}
+			record.Retries = attempt
+			record.Termination = TerminationNoBackend
+			return
+		}
+
+		record.Termination = TerminationComplete
+		switch {
+		case errors.Is(state.err, context.Canceled):
+			// the client went away before the answer
+			record.Termination = TerminationClientError
+		case state.err != nil:
+			record.Termination = TerminationBackendError
+		}
+
+		// server errors count as failures of the backend for the outlier detection
+		switch {
+		case state.err != nil:
+			loadBalancer.healthChecker.ReportFailure(backend.URL, "request failed")
+		case state.statusCode >= http.StatusInternalServerError:
+			loadBalancer.healthChecker.ReportFailure(backend.URL, "status "+strconv.Itoa(state.statusCode))
+		default:
+			loadBalancer.healthChecker.ReportSuccess(backend.URL)
+		}
+		return
+	}
+}
+
+// countingResponseWriter records the status and the body size of the answer sent to the client, for the access log
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (writer *countingResponseWriter) WriteHeader(statusCode int) {
+	// informational answers (100 Continue...) are followed by the real one
+	if writer.status == 0 && statusCode >= http.StatusOK {
+		writer.status = statusCode
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (writer *countingResponseWriter) Write(p []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	n, err := writer.ResponseWriter.Write(p)
+	writer.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets the ReverseProxy flush and hijack (websockets) the connection through http.ResponseController
+func (writer *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// limitedResponseWriter throttles and counts the body of the answer sent to the client
+// a hijacked connection (websockets) goes through Unwrap and is neither throttled nor counted
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+	counter  prometheus.Counter
+}
+
+func (writer *limitedResponseWriter) Write(p []byte) (int, error) {
+	waitLimiters(writer.ctx, writer.limiters, len(p))
+	n, err := writer.ResponseWriter.Write(p)
+	writer.counter.Add(float64(n))
+	return n, err
+}
+
+// Unwrap lets the ReverseProxy flush and hijack the connection through http.ResponseController
+func (writer *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// limitedBody is the request body sent to the backend, read through the limiters and the byte counter
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// countingBody counts the bytes of the request body read by the proxy
+// the transport may still be sending the body when the answer is back, hence the atomic
+type countingBody struct {
+	io.ReadCloser
+	read atomic.Int64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read.Add(int64(n))
+	return n, err
+}
+
+// rewrite points the request to the backend of the attempt and adds the X-Forwarded-* headers
+func (httpProxy *HTTPProxy) rewrite(proxyRequest *httputil.ProxyRequest) {
+	state := proxyRequest.In.Context().Value(attemptContextKey{}).(*httpAttempt)
+	proxyRequest.SetURL(&url.URL{Scheme: "http", Host: state.backend.URL})
+	// SetXForwarded replaces the X-Forwarded-For of the client, keep the chain of the proxies before us
+	proxyRequest.Out.Header["X-Forwarded-For"] = proxyRequest.In.Header["X-Forwarded-For"]
+	proxyRequest.SetXForwarded()
+	proxyRequest.Out.Host = proxyRequest.In.Host
+}
+
+// modifyResponse records the status code of the backend and sets the affinity cookie
+func (httpProxy *HTTPProxy) modifyResponse(response *http.Response) error {
+	state := response.Request.Context().Value(attemptContextKey{}).(*httpAttempt)
+	state.statusCode = response.StatusCode
+	if state.setCookie {
+		response.Header.Add("Set-Cookie", httpProxy.affinity.createCookie(state.backend).String())
+	}
+	return nil
+}
+
+// handleError is called when the backend could not be reached or did not answer
+// nothing is written for a dial failure that will be retried on another backend
+func (httpProxy *HTTPProxy) handleError(writer http.ResponseWriter, request *http.Request, err error) {
+	state := request.Context().Value(attemptContextKey{}).(*httpAttempt)
+	state.err = err
+	var opErr *net.OpError
+	state.dialFailed = errors.As(err, &opErr) && opErr.Op == "dial"
+	if state.dialFailed && state.canRetry {
+		return
+	}
+	if !errors.Is(err, context.Canceled) {
+		log.Printf("Error proxying %s %s to %s: %v", request.Method, request.URL.Path, state.backend.URL, err)
+	}
+	writer.WriteHeader(http.StatusBadGateway)
+}
+
+// Shutdown lets the running requests end within the grace period and closes the idle keep-alive connections
+func (httpProxy *HTTPProxy) Shutdown(grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := httpProxy.httpServer.Shutdown(ctx); err != nil {
+		log.Println("Grace period over, closing the remaining HTTP connections")
+		httpProxy.httpServer.Close()
+	}
+}
+
+// connListener is the net.Listener of the http server, its connections are accepted by the Server
+// and pushed to it once they passed the connection limits, the PROXY protocol and TLS
+type connListener struct {
+	connections chan net.Conn
+	closed      chan struct{}
+	closeOnce   sync.Once
+
+	// pool of every connection until the http server picked it up
+	mutex sync.Mutex
+	pools map[net.Conn]*LoadBalancer
+}
+
+// create an empty connListener
+func createConnListener() *connListener {
+	return &connListener{
+		connections: make(chan net.Conn),
+		closed:      make(chan struct{}),
+		pools:       make(map[net.Conn]*LoadBalancer),
+	}
+}
+
+// push hands a connection to the http server, it is closed if the listener is already closed
+func (listener *connListener) push(connection net.Conn, loadBalancer *LoadBalancer) {
+	listener.mutex.Lock()
+	listener.pools[connection] = loadBalancer
+	listener.mutex.Unlock()
+
+	select {
+	case listener.connections <- connection:
+	case <-listener.closed:
+		listener.pool(connection)
+		connection.Close()
+	}
+}
+
+// pool returns and forgets the pool of a connection
+func (listener *connListener) pool(connection net.Conn) *LoadBalancer {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	loadBalancer := listener.pools[connection]
+	delete(listener.pools, connection)
+	return loadBalancer
+}
+
+// Accept returns the next connection pushed to the listener
+func (listener *connListener) Accept() (net.Conn, error) {
+	select {
+	case connection := <-listener.connections:
+		return connection, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the Accept calls
+func (listener *connListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+	})
+	return nil
+}
+
+// Addr is only there to fullfil the net.Listener interface, the real listener belongs to the Server
+func (listener *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// create a pool of the given backends in http mode and its proxy, the access log goes to the returned buffer
+func createTestHTTPProxy(t *testing.T, backends string, attempts string) (*HTTPProxy, *LoadBalancer, *bytes.Buffer) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{
+		"LB_MODE":             ListenerModeHTTP,
+		"LB_BACKENDS":         backends,
+		"LB_ALGORITHM":        "roundrobin",
+		"LB_CONNECT_ATTEMPTS": attempts,
+		"LB_HEALTH_TYPE":      "none",
+		"LB_METRICS_PORT":     "off",
+	})
+	accessLog := &bytes.Buffer{}
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), &AccessLogger{writer: accessLog})
+	t.Cleanup(loadBalancer.Stop)
+	httpProxy := createHTTPProxy(config)
+	t.Cleanup(func() { httpProxy.Shutdown(0) })
+	return httpProxy, loadBalancer, accessLog
+}
+
+// send a request through the proxy as if it came on a connection of the pool
+func serveTestRequest(httpProxy *HTTPProxy, loadBalancer *LoadBalancer, request *http.Request) *httptest.ResponseRecorder {
+	request = request.WithContext(context.WithValue(request.Context(), poolContextKey{}, loadBalancer))
+	recorder := httptest.NewRecorder()
+	httpProxy.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// a failed dial is retried on another backend, unless the request has a body or no attempt is left
+func TestHTTPProxyRetry(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, "live")
+	}))
+	defer live.Close()
+	liveURL := strings.TrimPrefix(live.URL, "http://")
+	// nothing listens on the port of a closed listener
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	deadURL := dead.Addr().String()
+
+	tests := []struct {
+		name            string
+		backends        string
+		attempts        string
+		body            string
+		wantStatus      int
+		wantBackend     string
+		wantRetries     int
+		wantTermination string
+	}{
+		{name: "live", backends: liveURL, attempts: "3", wantStatus: http.StatusOK, wantBackend: liveURL, wantTermination: TerminationComplete},
+		{name: "dead then live", backends: deadURL + "," + liveURL, attempts: "3", wantStatus: http.StatusOK, wantBackend: liveURL, wantRetries: 1, wantTermination: TerminationComplete},
+		{name: "no attempt left", backends: deadURL + "," + liveURL, attempts: "1", wantStatus: http.StatusBadGateway, wantBackend: deadURL, wantRetries: 1, wantTermination: TerminationNoBackend},
+		{name: "only dead", backends: deadURL, attempts: "3", wantStatus: http.StatusServiceUnavailable, wantBackend: deadURL, wantRetries: 1, wantTermination: TerminationNoBackend},
+		{name: "body is not sent again", backends: deadURL + "," + liveURL, attempts: "3", body: "hello", wantStatus: http.StatusBadGateway, wantBackend: deadURL, wantRetries: 1, wantTermination: TerminationNoBackend},
+	}
+	for _, test := range tests {
+		httpProxy, loadBalancer, accessLog := createTestHTTPProxy(t, test.backends, test.attempts)
+
+		request := httptest.NewRequest(http.MethodGet, "/users", nil)
+		if test.body != "" {
+			request = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(test.body))
+		}
+		response := serveTestRequest(httpProxy, loadBalancer, request)
+		if response.Code != test.wantStatus {
+			t.Errorf("%s: status %d, want %d", test.name, response.Code, test.wantStatus)
+		}
+		if test.wantStatus == http.StatusOK && response.Body.String() != "live" {
+			t.Errorf("%s: answer %q, want the live backend", test.name, response.Body.String())
+		}
+
+		var record accessRecord
+		if err := json.Unmarshal(accessLog.Bytes(), &record); err != nil {
+			t.Fatalf("%s: access log %q: %v", test.name, accessLog.String(), err)
+		}
+		if record.Backend != test.wantBackend || record.Retries != test.wantRetries || record.Termination != test.wantTermination {
+			t.Errorf("%s: access log has backend %q, %d retries, %s, want %q, %d retries, %s", test.name,
+				record.Backend, record.Retries, record.Termination, test.wantBackend, test.wantRetries, test.wantTermination)
+		}
+	}
+}
+
+// a request feeds the latency of leastresponse and the byte counters of its backend
+func TestHTTPProxyFeedsBackend(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.Copy(io.Discard, request.Body)
+		io.WriteString(writer, "hello world")
+	}))
+	defer live.Close()
+	liveURL := strings.TrimPrefix(live.URL, "http://")
+
+	httpProxy, loadBalancer, _ := createTestHTTPProxy(t, liveURL, "1")
+	bytesIn := loadBalancer.metrics.bytesTotal.WithLabelValues(liveURL, "in")
+	bytesOut := loadBalancer.metrics.bytesTotal.WithLabelValues(liveURL, "out")
+	in, out := testutil.ToFloat64(bytesIn), testutil.ToFloat64(bytesOut)
+
+	response := serveTestRequest(httpProxy, loadBalancer, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("ping")))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d", response.Code)
+	}
+	if got := testutil.ToFloat64(bytesIn) - in; got != 4 {
+		t.Errorf("%v bytes counted in, want 4", got)
+	}
+	if got := testutil.ToFloat64(bytesOut) - out; got != 11 {
+		t.Errorf("%v bytes counted out, want 11", got)
+	}
+	if loadBalancer.healthChecker.getBackend(liveURL).AverageLatency() <= 0 {
+		t.Errorf("the request did not feed the latency of the backend")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// weight of a new sample in the exponentially weighted moving averages
+const latencyDecay = 0.2
+
+// latencyState holds the moving averages of a backend, protected by the mutex of the Backend
+type latencyState struct {
+	// both stay 0 until the first measurement, an unmeasured backend has no latency yet
+	connect   time.Duration
+	firstByte time.Duration
+}
+
+// firstByteReader wraps the reader of a backend connection and reports when the first byte arrives
+type firstByteReader struct {
+	reader  io.Reader
+	backend *Backend
+	start   time.Time
+	seen    bool
+}
+
+// return the number of connections currently forwarded to the backend
+func (backend *Backend) ActiveConnections() int64 {
+	return backend.activeConnections.Load()
+}
+
+// AverageLatency returns the average connect time plus time to first byte of a backend in a threadsafe manner
+func (backend *Backend) AverageLatency() time.Duration {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+	return backend.latency.connect + backend.latency.firstByte
+}
+
+// record the time a dial to the backend took
+func (backend *Backend) observeConnect(duration time.Duration) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.latency.connect = movingAverage(backend.latency.connect, duration)
+}
+
+// record the time the backend took to send its first byte
+func (backend *Backend) observeFirstByte(duration time.Duration) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.latency.firstByte = movingAverage(backend.latency.firstByte, duration)
+}
+
+// movingAverage adds a sample to an exponentially weighted moving average, the first sample is taken as is
+func movingAverage(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(latencyDecay*float64(sample) + (1-latencyDecay)*float64(average))
+}
+
+// create a reader that measures the time to first byte of a backend connection, starting now
+func createFirstByteReader(reader io.Reader, backend *Backend) io.Reader {
+	return &firstByteReader{reader: reader, backend: backend, start: time.Now()}
+}
+
+// we have to implement the Read method to fullfil the Readers interface
+func (reader *firstByteReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 && !reader.seen {
+		reader.seen = true
+		reader.backend.observeFirstByte(time.Since(reader.start))
+	}
+	return n, err
+}
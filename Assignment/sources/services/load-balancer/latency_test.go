@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMovingAverage(t *testing.T) {
+	tests := []struct {
+		average time.Duration
+		sample  time.Duration
+		want    time.Duration
+	}{
+		// the first sample is taken as is
+		{average: 0, sample: 10 * time.Millisecond, want: 10 * time.Millisecond},
+		{average: 10 * time.Millisecond, sample: 10 * time.Millisecond, want: 10 * time.Millisecond},
+		{average: 10 * time.Millisecond, sample: 20 * time.Millisecond, want: 12 * time.Millisecond},
+		{average: 10 * time.Millisecond, sample: 0, want: 8 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := movingAverage(test.average, test.sample); got != test.want {
+			t.Errorf("movingAverage(%s, %s) = %s, want %s", test.average, test.sample, got, test.want)
+		}
+	}
+}
+
+// only the first read with data is measured
+func TestFirstByteReader(t *testing.T) {
+	backend := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, &HealthCheckConfig{})
+	reader := createFirstByteReader(io.MultiReader(bytes.NewReader(nil), bytes.NewReader([]byte("hello"))), backend)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if backend.latency.firstByte < 5*time.Millisecond {
+		t.Errorf("time to first byte = %s, want at least 5ms", backend.latency.firstByte)
+	}
+	if backend.latency.connect != 0 {
+		t.Errorf("the reader recorded a connect time of %s", backend.latency.connect)
+	}
+}
@@ -1,72 +1,193 @@
 package main
 
 import (
-	"hash/fnv"
-	"io"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math"
+	"math/rand/v2"
 	"net"
 	"sync"
-
-	"golang.org/x/time/rate"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // represents a LoadBalancer
 type LoadBalancer struct {
 	config *Config
+	// algorithm in use, it starts as config.Algorithm and can be switched at runtime (admin api)
+	algorithm atomic.Value
 	// next is the index of the backend to use for the next connection for roundrobin
 	next int
-	// connCounts tracks active connections for leastconn
-	connCounts map[string]int
-	// we use a mutex to handle next and connCounts since they are shared variables to track all connections
+	// currentWeights holds the running weights of the smooth weighted roundrobin
+	currentWeights map[string]float64
+	// hasher maps client IPs to backends for the hashing algorithm
+	hasher *hashBalancer
+	// we use a mutex to handle next and currentWeights since they are shared variables to track all connections
+	// the active connection counts live on the backends as atomics so leastconn and p2c do not need it
 	mutex sync.Mutex
 	// The new HealthChecker instance
 	healthChecker *HealthChecker
+	metrics       *MetricsHandler
+	// hands out the bandwidth limiters of every connection
+	bandwidth *BandwidthLimiter
+	// opens the backend connections with the connect timeout and keepalive settings
+	dialer *net.Dialer
+	// one record per connection, nil when disabled
+	accessLog *AccessLogger
+	// keeps the backends in sync with a dns name, nil when disabled
+	discovery *DNSDiscovery
 }
 
 // createLoadBalancer initializes the LoadBalancer, including connection counts and the HealthChecker.
-func createLoadBalancer(config *Config) *LoadBalancer {
+func createLoadBalancer(config *Config, metrics *MetricsHandler, accessLog *AccessLogger) *LoadBalancer {
 
-	hc := createHealthChecker(config.Backends)
+	hc := createHealthChecker(config.Backends, config.HealthCheck, config.Outlier, config.PriorityThreshold)
+	hc.metrics = metrics
 	hc.Start()
 
-	connCounts := make(map[string]int)
-	for _, backend := range config.Backends {
-		connCounts[backend] = 0
+	loadBalancer := &LoadBalancer{
+		config:         config,
+		next:           0,
+		currentWeights: make(map[string]float64),
+		hasher:         createHashBalancer(config.HashMode, config.HashVirtualNodes),
+		healthChecker:  hc,
+		metrics:        metrics,
+		bandwidth:      createBandwidthLimiter(config.Bandwidth),
+		dialer:         createDialer(config),
+		accessLog:      accessLog,
 	}
+	loadBalancer.algorithm.Store(config.Algorithm)
 
-	return &LoadBalancer{
-		config:        config,
-		next:          0,
-		connCounts:    connCounts,
-		healthChecker: hc,
+	if config.Discovery != nil {
+		loadBalancer.discovery = createDNSDiscovery(loadBalancer, config.Discovery, createResolver(config.Discovery.Server))
+		loadBalancer.discovery.Start()
 	}
+	return loadBalancer
 }
 
-// selectBackend chooses a backend based on the configured algorithm, using only healthy backends.
-func (loadBalancer *LoadBalancer) selectBackend(clientIP string) string {
+// Algorithm returns the algorithm currently in use
+func (loadBalancer *LoadBalancer) Algorithm() string {
+	return loadBalancer.algorithm.Load().(string)
+}
 
-	healthyBackends := loadBalancer.healthChecker.GetHealthyBackends()
+// SetAlgorithm switches the algorithm, the next connection already uses the new one
+func (loadBalancer *LoadBalancer) SetAlgorithm(algorithm string) error {
+	if !isValidAlgorithm(algorithm) {
+		return fmt.Errorf("invalid algorithm %q", algorithm)
+	}
+	loadBalancer.algorithm.Store(algorithm)
+	log.Printf("Algorithm switched to %s", algorithm)
+	return nil
+}
+
+// Stop stops the background work of the load balancer (the dns discovery and the health checks)
+func (loadBalancer *LoadBalancer) Stop() {
+	if loadBalancer.discovery != nil {
+		loadBalancer.discovery.Stop()
+	}
+	loadBalancer.healthChecker.Stop()
+}
+
+// AddBackend adds a backend at runtime, see HealthChecker.AddBackend
+func (loadBalancer *LoadBalancer) AddBackend(backendConfig BackendConfig) (*Backend, error) {
+	return loadBalancer.healthChecker.AddBackend(backendConfig)
+}
+
+// RemoveBackend removes a backend at runtime, its running connections are not cut
+func (loadBalancer *LoadBalancer) RemoveBackend(backendURL string) error {
+	if _, err := loadBalancer.healthChecker.RemoveBackend(backendURL); err != nil {
+		return err
+	}
+	loadBalancer.mutex.Lock()
+	defer loadBalancer.mutex.Unlock()
+	delete(loadBalancer.currentWeights, backendURL)
+	return nil
+}
+
+// DrainBackend stops sending new connections to a backend and removes it once its last connection ended
+func (loadBalancer *LoadBalancer) DrainBackend(backendURL string) error {
+	backend := loadBalancer.healthChecker.getBackend(backendURL)
+	if backend == nil {
+		return fmt.Errorf("backend %s not found", backendURL)
+	}
+	backend.SetMode(ModeDrain)
+	log.Printf("Draining backend %s (%d active connections)", backendURL, backend.ActiveConnections())
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			// put back in rotation, or replaced by another backend with the same url meanwhile
+			if backend.Mode() != ModeDrain || loadBalancer.healthChecker.getBackend(backendURL) != backend {
+				return
+			}
+			if backend.ActiveConnections() == 0 {
+				loadBalancer.RemoveBackend(backendURL)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// selectBackend chooses a backend based on the configured algorithm, using only healthy backends.
+// backends in excluded (already tried for this connection) are skipped
+func (loadBalancer *LoadBalancer) selectBackend(clientIP string, excluded map[string]bool) *Backend {
 
+	healthyBackends := loadBalancer.candidates(excluded)
 	if len(healthyBackends) == 0 {
 		log.Println("No healthy backends available.")
-		return ""
+		return nil
+	}
+
+	algorithm := loadBalancer.Algorithm()
+	backend := loadBalancer.runAlgorithm(algorithm, clientIP, healthyBackends)
+	loadBalancer.metrics.selectionsTotal.WithLabelValues(algorithm, backend.URL).Inc()
+	return backend
+}
+
+// candidates returns the healthy backends that are not in excluded
+func (loadBalancer *LoadBalancer) candidates(excluded map[string]bool) []*Backend {
+	healthyBackends := loadBalancer.healthChecker.GetHealthyBackends()
+	if len(excluded) == 0 {
+		return healthyBackends
 	}
+	candidates := make([]*Backend, 0, len(healthyBackends))
+	for _, backend := range healthyBackends {
+		if !excluded[backend.URL] {
+			candidates = append(candidates, backend)
+		}
+	}
+	return candidates
+}
 
-	switch loadBalancer.config.Algorithm {
+// runAlgorithm picks one of the healthy backends with the given algorithm
+func (loadBalancer *LoadBalancer) runAlgorithm(algorithm string, clientIP string, healthyBackends []*Backend) *Backend {
+	switch algorithm {
 	case "roundrobin":
 		return loadBalancer.roundRobin(healthyBackends)
+	case "weighted_roundrobin":
+		return loadBalancer.weightedRoundRobin(healthyBackends)
 	case "leastconn":
 		return loadBalancer.leastConn(healthyBackends)
+	case "weighted_leastconn":
+		return loadBalancer.weightedLeastConn(healthyBackends)
 	case "hashing":
 		return loadBalancer.hashing(clientIP, healthyBackends)
+	case "p2c":
+		return loadBalancer.powerOfTwoChoices(healthyBackends)
+	case "leastresponse":
+		return loadBalancer.leastResponse(healthyBackends)
 	default:
 		return loadBalancer.roundRobin(healthyBackends)
 	}
 }
 
 // implements the roundRobin algorithm and gives back the next backend to handle
-func (loadBalancer *LoadBalancer) roundRobin(backends []string) string {
+func (loadBalancer *LoadBalancer) roundRobin(backends []*Backend) *Backend {
 	loadBalancer.mutex.Lock()
 	defer loadBalancer.mutex.Unlock()
 
@@ -77,23 +198,51 @@ func (loadBalancer *LoadBalancer) roundRobin(backends []string) string {
 		loadBalancer.next = 0
 	}
 
-	backend := backends[loadBalancer.next]
-	// Increment 'next' for the next connection, wrapping around the healthy list length with modulo
-	loadBalancer.next = (loadBalancer.next + 1) % len(backends)
+	var backend *Backend
+	for range backends {
+		backend = backends[loadBalancer.next]
+		// Increment 'next' for the next connection, wrapping around the healthy list length with modulo
+		loadBalancer.next = (loadBalancer.next + 1) % len(backends)
+		// a backend in slow start only takes its turn with a probability growing with its ramp up
+		if factor := backend.slowStartFactor(loadBalancer.config.SlowStart); factor >= 1 || rand.Float64() < factor {
+			break
+		}
+	}
 	return backend
 }
 
-// implements the leastConn algorithm and gives back the next backend to handle
-func (loadBalancer *LoadBalancer) leastConn(backends []string) string {
+// implements the smooth weighted round robin algorithm (the one nginx uses) and gives back the next backend to handle
+// every round each backend gains its weight, the one with the highest current weight is chosen and loses the total weight
+// this spreads the picks of a heavy backend instead of sending it a burst of connections in a row
+func (loadBalancer *LoadBalancer) weightedRoundRobin(backends []*Backend) *Backend {
 	loadBalancer.mutex.Lock()
 	defer loadBalancer.mutex.Unlock()
 
-	minConns := math.MaxInt32
-	var selectedBackend string
+	totalWeight := 0.0
+	var selectedBackend *Backend
+	for _, backend := range backends {
+		weight := loadBalancer.effectiveWeight(backend)
+		loadBalancer.currentWeights[backend.URL] += weight
+		totalWeight += weight
+		if selectedBackend == nil || loadBalancer.currentWeights[backend.URL] > loadBalancer.currentWeights[selectedBackend.URL] {
+			selectedBackend = backend
+		}
+	}
+
+	loadBalancer.currentWeights[selectedBackend.URL] -= totalWeight
+	return selectedBackend
+}
+
+// implements the leastConn algorithm and gives back the next backend to handle
+// the count includes the new connection and is scaled by the slow start, otherwise
+// a backend that just came up would get every new connection since it has none
+func (loadBalancer *LoadBalancer) leastConn(backends []*Backend) *Backend {
+	minConns := math.Inf(1)
+	var selectedBackend *Backend
 
 	// Iterate over only the healthy backends
 	for _, backend := range backends {
-		count := loadBalancer.connCounts[backend]
+		count := float64(backend.ActiveConnections()+1) / backend.slowStartFactor(loadBalancer.config.SlowStart)
 		if count < minConns {
 			minConns = count
 			selectedBackend = backend
@@ -103,92 +252,268 @@ func (loadBalancer *LoadBalancer) leastConn(backends []string) string {
 	return selectedBackend
 }
 
+// implements the weighted leastConn algorithm and gives back the next backend to handle
+// the backend with the lowest number of connections (the new one included) per unit of effective weight wins
+func (loadBalancer *LoadBalancer) weightedLeastConn(backends []*Backend) *Backend {
+	var selectedBackend *Backend
+	bestLoad := math.Inf(1)
+
+	for _, backend := range backends {
+		load := float64(backend.ActiveConnections()+1) / loadBalancer.effectiveWeight(backend)
+		if load < bestLoad {
+			selectedBackend = backend
+			bestLoad = load
+		}
+	}
+
+	return selectedBackend
+}
+
 // implements the hashing algorithm and gives back the next backend to handle
-func (loadBalancer *LoadBalancer) hashing(clientIP string, backends []string) string {
-	// fnv == Package fnv implements non-cryptographic hash functions for us
-	hash := fnv.New32a()
-	// hash the clientIP with 32a algo
-	hash.Write([]byte(clientIP))
+// a plain modulo over the healthy backends remapped almost every client whenever one backend went up or down,
+// so we use consistent hashing (see hashing.go) and only the clients of that backend move
+// the slow start does not apply here: scaling the share of a backend would move clients back and forth
+func (loadBalancer *LoadBalancer) hashing(clientIP string, backends []*Backend) *Backend {
+	return loadBalancer.hasher.pick(clientIP, backends)
+}
 
-	// with modulo we can distribute the indexes in function of the number of *healthy* backends we have
-	index := int(hash.Sum32()) % len(backends)
-	return backends[index]
+// implements the power of two choices algorithm and gives back the next backend to handle
+// we pick two random backends and keep the one with less connections per unit of effective weight
+// this is almost as good as leastconn but only looks at two backends instead of scanning all of them
+func (loadBalancer *LoadBalancer) powerOfTwoChoices(backends []*Backend) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+
+	first := rand.N(len(backends))
+	// draw the second one among the others so we never compare a backend with itself
+	second := rand.N(len(backends) - 1)
+	if second >= first {
+		second++
+	}
+
+	firstBackend, secondBackend := backends[first], backends[second]
+	firstLoad := float64(firstBackend.ActiveConnections()+1) / loadBalancer.effectiveWeight(firstBackend)
+	secondLoad := float64(secondBackend.ActiveConnections()+1) / loadBalancer.effectiveWeight(secondBackend)
+	if secondLoad < firstLoad {
+		return secondBackend
+	}
+	return firstBackend
 }
 
-// increment the count of connections of a given backend in our connCounts list
-func (loadBalancer *LoadBalancer) increment(backendHost string) {
-	loadBalancer.mutex.Lock()
-	defer loadBalancer.mutex.Unlock()
-	loadBalancer.connCounts[backendHost]++
+// implements the least response time algorithm and gives back the next backend to handle
+// every backend is scored by its average latency (connect + time to first byte, see latency.go)
+// times its load, so slow backends that are still alive get less traffic
+// backends we have no measurement for yet score 0 and are tried first
+func (loadBalancer *LoadBalancer) leastResponse(backends []*Backend) *Backend {
+	var selectedBackend *Backend
+	bestScore := math.Inf(1)
+
+	for _, backend := range backends {
+		load := float64(backend.ActiveConnections()+1) / loadBalancer.effectiveWeight(backend)
+		score := backend.AverageLatency().Seconds() * load
+		if score < bestScore {
+			bestScore = score
+			selectedBackend = backend
+		}
+	}
+
+	return selectedBackend
 }
 
-// decrement the count of connections of a given backend in our connCounts list
-func (loadBalancer *LoadBalancer) decrement(backendHost string) {
-	loadBalancer.mutex.Lock()
-	defer loadBalancer.mutex.Unlock()
-	loadBalancer.connCounts[backendHost]--
+// increment the count of active connections of a given backend
+func (loadBalancer *LoadBalancer) increment(backend *Backend) {
+	backend.activeConnections.Add(1)
+	loadBalancer.metrics.activeConnections.WithLabelValues(backend.URL).Inc()
+	loadBalancer.metrics.connectionsTotal.WithLabelValues(backend.URL).Inc()
+}
+
+// decrement the count of active connections of a given backend
+func (loadBalancer *LoadBalancer) decrement(backend *Backend) {
+	backend.activeConnections.Add(-1)
+	loadBalancer.metrics.activeConnections.WithLabelValues(backend.URL).Dec()
+}
+
+// connectBackend selects a backend and opens the connection to it
+// nothing has been forwarded yet at this point, so if the dial fails we can safely try the next candidate
+// returns the chosen backend and its connection, or nil when every attempt failed
+// the algorithm, retries and connect time are noted in the access log record
+func (loadBalancer *LoadBalancer) connectBackend(clientIP string, record *accessRecord) (*Backend, net.Conn) {
+	record.Algorithm = loadBalancer.Algorithm()
+	tried := make(map[string]bool)
+	for attempt := 1; attempt <= loadBalancer.config.ConnectAttempts; attempt++ {
+		backend := loadBalancer.selectBackend(clientIP, tried)
+		if backend == nil {
+			return nil, nil
+		}
+		backendHost := backend.URL
+
+		dialStart := time.Now()
+		backendConnection, err := loadBalancer.dialer.Dial("tcp", backendHost)
+		if err == nil {
+			connectTime := time.Since(dialStart)
+			backend.observeConnect(connectTime)
+			record.Backend = backendHost
+			record.ConnectMs = milliseconds(connectTime)
+			return backend, backendConnection
+		}
+		record.Retries = attempt
+
+		log.Printf("Failed to connect to backend %s (attempt %d/%d): %v", backendHost, attempt, loadBalancer.config.ConnectAttempts, err)
+		loadBalancer.metrics.dialFailures.WithLabelValues(backendHost).Inc()
+		loadBalancer.healthChecker.ReportFailure(backendHost, "dial failed")
+		tried[backendHost] = true
+	}
+	return nil, nil
 }
 
 // handle a client connection
 // forward the traffic correctly to the correct backend ( depending on the algorithm chosen)
 // update the data stored in the structs for the next iterations of the algorithms
-func (loadBalancer *LoadBalancer) handleConnection(clientConnection net.Conn) {
+// when one side is done sending the other one is half-closed, so it still gets the rest of the answer
+// both connections are closed early if forceClose is cancelled (end of the shutdown grace period),
+// when the session is idle or too old (LB_IDLE_TIMEOUT, LB_MAX_SESSION_LIFETIME) or when a direction fails
+// config is the one of the listener the connection came in on, its session settings override the ones of the pool
+func (loadBalancer *LoadBalancer) handleConnection(forceClose context.Context, clientConnection net.Conn, config *Config) {
 	defer clientConnection.Close() // prepare the closing of connections if handle Connection ends
 
+	record := &accessRecord{
+		Time:     time.Now(),
+		Protocol: ListenerModeTCP,
+		Client:   clientConnection.RemoteAddr().String(),
+		Frontend: clientConnection.LocalAddr().String(),
+	}
+	defer loadBalancer.accessLog.write(record)
+
 	// only used for the hashing algorithm
 	clientIP, _, err := net.SplitHostPort(clientConnection.RemoteAddr().String())
 	if err != nil {
 		log.Printf("Failed to parse client IP: %v", err)
 	}
 
-	backendHost := loadBalancer.selectBackend(clientIP)
-
-	if backendHost == "" {
-		log.Printf("Could not select a healthy backend for %s. Closing connection.", clientConnection.RemoteAddr())
+	backend, backendConnection := loadBalancer.connectBackend(clientIP, record)
+	if backendConnection == nil {
+		log.Printf("Could not connect to a healthy backend for %s. Closing connection.", clientConnection.RemoteAddr())
+		record.Termination = TerminationNoBackend
 		return
 	}
+	defer backendConnection.Close()
 
-	backendConnection, err := net.Dial("tcp", backendHost)
-	if err != nil {
-		log.Printf("Failed to connect to backend %s: %v", backendHost, err)
-		return
+	// tell the backend who the real client is before any of its data
+	if version := config.ProxyProtocolSend; version != "" {
+		err := writeProxyHeader(backendConnection, version, clientConnection.RemoteAddr(), clientConnection.LocalAddr())
+		if err != nil {
+			log.Printf("Failed to send the PROXY header to backend %s: %v", backend.URL, err)
+			record.Termination = TerminationBackendError
+			return
+		}
+	}
+
+	session, endSession := startSession(forceClose, config.MaxSessionLifetime)
+	defer endSession(nil)
+	stopForceClose := context.AfterFunc(session, func() {
+		clientConnection.Close()
+		backendConnection.Close()
+	})
+	defer stopForceClose()
+
+	var idle *idleWatcher
+	if timeout := config.IdleTimeout; timeout > 0 {
+		idle = watchIdle(timeout, func() { endSession(errIdleTimeout) })
+		defer idle.Stop()
 	}
-	defer backendConnection.Close()
 
 	// Increment connection count for leastconn algorithm
-	loadBalancer.increment(backendHost)
-	defer loadBalancer.decrement(backendHost)
+	backendHost := backend.URL
+	loadBalancer.increment(backend)
+	defer loadBalancer.decrement(backend)
+
+	// one set of limiters per direction: this connection, the client IP, the backend and the whole balancer
+	upLimiters, downLimiters, releaseLimiters := loadBalancer.bandwidth.acquire(clientIP, backendHost, config.Bandwidth)
+	defer releaseLimiters()
 
-	// Convert Rate (MB/s) to bytes/second
-	// 1 MB/s = 1024 * 1024 Bytes/s
-	rateInBytes := loadBalancer.config.Rate * 1024 * 1024
-	limiter := rate.NewLimiter(rate.Limit(rateInBytes), int(rateInBytes))
 	// Forward traffic in both directions
 	var wg sync.WaitGroup
 	wg.Add(2)
+	startTime := time.Now()
+	var clientErr, backendErr error
+	var bytesFromClient, bytesFromBackend int64
+	// the side that was done first tells who ended a session that closed normally
+	doneFirst := make(chan string, 2)
 
 	// Client -> Backend (applying rate limiting to the client's data transfer)
 	go func() {
 		defer wg.Done()
-		rateLimitedReader := createRateLimitedReader(clientConnection, limiter) // wrap the client connection Reader with our rateLimiter
-		//dataplane: forwarding or raw tcp traffic
-		_, err := io.Copy(backendConnection, rateLimitedReader)
-		if err != nil && err != io.EOF {
-			log.Printf("Error copying client->backend: %v", err)
-		}
+		//dataplane: forwarding or raw tcp traffic, spliced when nothing has to look at it (see splice.go)
+		bytesFromClient, clientErr = loadBalancer.copyDirection(session, backendConnection, clientConnection, upLimiters, idle, backendHost, "in", nil)
+		doneFirst <- sideClient
+		loadBalancer.endDirection(session, endSession, backendConnection, clientErr, sideClient)
 	}()
 
 	// Backend -> Client (applying rate limiting to the backend's data transfer)
 	go func() {
 		defer wg.Done()
-		rateLimitedReader := createRateLimitedReader(backendConnection, limiter)
-		//dataplane: forwarding or raw tcp traffic
-		_, err := io.Copy(clientConnection, rateLimitedReader) // Backend -> Client
-		if err != nil && err != io.EOF {
-			log.Printf("Error copying backend->client: %v", err)
-		}
+		// the first byte coming back from the backend feeds the latency average of leastresponse
+		bytesFromBackend, backendErr = loadBalancer.copyDirection(session, clientConnection, backendConnection, downLimiters, idle, backendHost, "out", backend)
+		doneFirst <- sideBackend
+		loadBalancer.endDirection(session, endSession, clientConnection, backendErr, sideBackend)
 	}()
 
 	wg.Wait()
+	duration := time.Since(startTime)
+	loadBalancer.metrics.connectionDuration.WithLabelValues(backendHost).Observe(duration.Seconds())
+	loadBalancer.reportSession(backendHost, duration, bytesFromBackend, clientErr, backendErr)
+	record.BytesIn, record.BytesOut = bytesFromClient, bytesFromBackend
+	record.Termination = sessionTermination(session, <-doneFirst)
+	if cause := context.Cause(session); cause != nil {
+		log.Printf("Connection from %s to %s closed (%v)", clientConnection.RemoteAddr(), backendHost, cause)
+		return
+	}
 	log.Printf("Connection from %s to %s closed", clientConnection.RemoteAddr(), backendHost)
 }
+
+// endDirection is called when the copy from the source side of a session stopped
+// on EOF the destination is half-closed so it knows nothing more is coming while the other direction keeps going,
+// on an error the whole session is ended since the other direction would otherwise wait for a peer that is gone
+func (loadBalancer *LoadBalancer) endDirection(session context.Context, endSession context.CancelCauseFunc, destination net.Conn, err error, source string) {
+	destinationSide := otherSide(source)
+	if err == nil {
+		if err := closeWrite(destination); err != nil && session.Err() == nil {
+			endSession(&sessionError{side: destinationSide, err: err})
+		}
+		return
+	}
+	// the errors of the connections we closed ourselves are not worth a log
+	if session.Err() == nil {
+		log.Printf("Error copying %s->%s: %v", source, destinationSide, err)
+		endSession(&sessionError{side: failedSide(err, source, destinationSide), err: err})
+	}
+}
+
+// failedSide tells which side of a direction made its copy fail: a failed write is the fault of the destination, a failed read the one of the source
+// a spliced copy reports both as a "readfrom" error, there only a broken pipe (which only a write gets) is known to come from the destination
+func failedSide(err error, source string, destination string) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" || errors.Is(err, syscall.EPIPE) {
+		return destination
+	}
+	return source
+}
+
+// reportSession feeds the outcome of a finished session to the passive outlier detection
+// resets from the backend and abnormally short sessions without any answer count as failures
+// clientErr and backendErr are the errors of the copies from the client and from the backend
+func (loadBalancer *LoadBalancer) reportSession(backendHost string, duration time.Duration, bytesFromBackend int64, clientErr error, backendErr error) {
+	healthChecker := loadBalancer.healthChecker
+	if isBackendReset(clientErr, sideClient) || isBackendReset(backendErr, sideBackend) {
+		healthChecker.ReportFailure(backendHost, "connection reset")
+		return
+	}
+
+	shortSession := loadBalancer.config.Outlier.ShortSession
+	if shortSession > 0 && duration < shortSession && bytesFromBackend == 0 {
+		healthChecker.ReportFailure(backendHost, "short session")
+		return
+	}
+	healthChecker.ReportSuccess(backendHost)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the metrics register themselves globally, so every test and benchmark shares one handler
+var (
+	testMetrics     *MetricsHandler
+	testMetricsOnce sync.Once
+)
+
+// sharedMetrics returns the metrics of the pool "test"
+func sharedMetrics() *MetricsHandler {
+	testMetricsOnce.Do(func() { testMetrics = createMetricsHandler() })
+	return testMetrics.forPool("test")
+}
+
+// quietLog drops the log of the balancer until the end of the test
+func quietLog(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// loadTestConfig loads a pool config from the given settings instead of the environment
+func loadTestConfig(t testing.TB, values map[string]string) *Config {
+	config, err := loadConfig(func(key string) string { return values[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// BenchmarkSession measures the throughput and the allocations of one forwarded connection:
+// the client sends the payload, half-closes and waits for the backend to close after reading everything
+//
+//	go test -run '^$' -bench Session -benchmem
+//
+// spliced has no bandwidth limit (LB_RATE=0), buffered gets a limit too high to ever throttle
+// so the copy goes through the rate limited reader
+func BenchmarkSession(b *testing.B) {
+	for _, payload := range []int{1 << 10, 1 << 20, 16 << 20} {
+		b.Run("spliced/"+strconv.Itoa(payload), func(b *testing.B) {
+			benchmarkSession(b, payload, map[string]string{"LB_RATE": "0"})
+		})
+		b.Run("buffered/"+strconv.Itoa(payload), func(b *testing.B) {
+			benchmarkSession(b, payload, map[string]string{"LB_RATE": "100000"})
+		})
+	}
+}
+
+// run the sessions of a benchmark through a balancer with the given settings in front of a sink backend
+func benchmarkSession(b *testing.B, payload int, overrides map[string]string) {
+	quietLog(b)
+
+	backendListener := listenSink(b)
+	values := map[string]string{
+		"LB_BACKENDS":     backendListener.Addr().String(),
+		"LB_METRICS_PORT": "off",
+		"LB_HEALTH_RISE":  "1",
+	}
+	for key, value := range overrides {
+		values[key] = value
+	}
+	loadBalancer := createLoadBalancer(loadTestConfig(b, values), sharedMetrics(), nil)
+	b.Cleanup(loadBalancer.Stop)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go loadBalancer.handleConnection(context.Background(), connection, loadBalancer.config)
+		}
+	}()
+
+	data := make([]byte, payload)
+	b.SetBytes(int64(payload))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		connection, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := connection.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		connection.(*net.TCPConn).CloseWrite()
+		// the sink closes once it read everything, so this returns when the whole payload went through
+		io.Copy(io.Discard, connection)
+		connection.Close()
+	}
+}
+
+// start a backend that reads every connection to the end and closes it
+func listenSink(b *testing.B) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, connection)
+				connection.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// a failed dial moves on to the next backend, and the same backend is not dialed twice for one connection
+func TestConnectBackendRetry(t *testing.T) {
+	quietLog(t)
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	// nothing listens on the port of a closed listener
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	tests := []struct {
+		name        string
+		backends    string
+		attempts    string
+		wantBackend string
+		wantRetries int
+	}{
+		{name: "dead then live", backends: dead.Addr().String() + "," + live.Addr().String(), attempts: "3", wantBackend: live.Addr().String(), wantRetries: 1},
+		{name: "no attempt left", backends: dead.Addr().String() + "," + live.Addr().String(), attempts: "1", wantRetries: 1},
+		{name: "only dead", backends: dead.Addr().String(), attempts: "3", wantRetries: 1},
+	}
+	for _, test := range tests {
+		config := loadTestConfig(t, map[string]string{
+			"LB_BACKENDS":         test.backends,
+			"LB_ALGORITHM":        "roundrobin",
+			"LB_CONNECT_ATTEMPTS": test.attempts,
+			"LB_HEALTH_TYPE":      "none",
+			"LB_METRICS_PORT":     "off",
+		})
+		loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+
+		record := &accessRecord{}
+		backend, backendConnection := loadBalancer.connectBackend("10.0.0.1", record)
+		if backendConnection != nil {
+			backendConnection.Close()
+		}
+		got := ""
+		if backend != nil {
+			got = backend.URL
+		}
+		if got != test.wantBackend || record.Retries != test.wantRetries {
+			t.Errorf("%s: connected to %q after %d retries, want %q after %d", test.name, got, record.Retries, test.wantBackend, test.wantRetries)
+		}
+		if backend != nil && record.Backend != backend.URL {
+			t.Errorf("%s: access record names backend %q, want %q", test.name, record.Backend, backend.URL)
+		}
+		loadBalancer.Stop()
+	}
+}
+
+// create the backends of a LB_BACKENDS value, alive and without slow start
+func createTestBackends(t testing.TB, backendsStr string) []*Backend {
+	backendConfigs, err := parseBackends(backendsStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]*Backend, 0, len(backendConfigs))
+	for _, backendConfig := range backendConfigs {
+		backend := createBackend(backendConfig, &HealthCheckConfig{Rise: 1, Fall: 1})
+		backend.recordProbe(true)
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// the smooth weighted roundrobin spreads the turns of a heavy backend instead of giving them in a row
+func TestWeightedRoundRobin(t *testing.T) {
+	loadBalancer := &LoadBalancer{config: &Config{}, currentWeights: make(map[string]float64)}
+	backends := createTestBackends(t, "a:1=5,b:1,c:1")
+
+	var got []string
+	for range 14 {
+		got = append(got, loadBalancer.weightedRoundRobin(backends).URL)
+	}
+	want := []string{"a:1", "a:1", "b:1", "a:1", "c:1", "a:1", "a:1"}
+	want = append(want, want...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("weighted roundrobin = %v, want %v", got, want)
+	}
+}
+
+// weighted leastconn keeps the connections of every backend proportional to its weight
+func TestWeightedLeastConn(t *testing.T) {
+	loadBalancer := &LoadBalancer{config: &Config{}}
+	backends := createTestBackends(t, "a:1=3,b:1=1")
+
+	counts := make(map[string]int)
+	for range 8 {
+		backend := loadBalancer.weightedLeastConn(backends)
+		backend.activeConnections.Add(1)
+		counts[backend.URL]++
+	}
+	if counts["a:1"] != 6 || counts["b:1"] != 2 {
+		t.Errorf("weighted leastconn spread 8 connections as %v, want a:1 6 and b:1 2", counts)
+	}
+}
+
+// least response prefers the unmeasured and the fast backends, weighted by their load
+func TestLeastResponse(t *testing.T) {
+	loadBalancer := &LoadBalancer{config: &Config{}}
+	backends := createTestBackends(t, "fast:1,slow:1,new:1")
+	backends[0].observeConnect(10 * time.Millisecond)
+	backends[1].observeConnect(50 * time.Millisecond)
+
+	if got := loadBalancer.leastResponse(backends).URL; got != "new:1" {
+		t.Errorf("least response picked %s, want the unmeasured backend new:1", got)
+	}
+	backends[2].observeConnect(30 * time.Millisecond)
+	if got := loadBalancer.leastResponse(backends).URL; got != "fast:1" {
+		t.Errorf("least response picked %s, want fast:1", got)
+	}
+	// 10ms with 4 connections scores higher than 30ms with none
+	backends[0].activeConnections.Store(4)
+	if got := loadBalancer.leastResponse(backends).URL; got != "new:1" {
+		t.Errorf("least response picked %s with fast:1 loaded, want new:1", got)
+	}
+}
+
+// p2c never picks the most loaded backend of the pool since it always has a less loaded rival
+func TestPowerOfTwoChoices(t *testing.T) {
+	loadBalancer := &LoadBalancer{config: &Config{}}
+	backends := createTestBackends(t, "a:1,b:1,c:1")
+	backends[0].activeConnections.Store(10)
+	backends[1].activeConnections.Store(5)
+
+	counts := make(map[string]int)
+	for range 1000 {
+		counts[loadBalancer.powerOfTwoChoices(backends).URL]++
+	}
+	if counts["a:1"] != 0 {
+		t.Errorf("p2c picked the most loaded backend %d times", counts["a:1"])
+	}
+	// c wins every draw it is part of, 2 out of 3
+	if counts["c:1"] < 600 || counts["c:1"] > 733 {
+		t.Errorf("p2c picked the least loaded backend %d times out of 1000, want about 667", counts["c:1"])
+	}
+
+	if got := loadBalancer.powerOfTwoChoices(backends[:1]).URL; got != "a:1" {
+		t.Errorf("p2c with one backend picked %s", got)
+	}
+}
+
+// the session settings come from the listener the connection came in on, not from the pool
+func TestHandleConnectionListenerSettings(t *testing.T) {
+	quietLog(t)
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendListener.Close()
+	header := make(chan string, 1)
+	go func() {
+		connection, err := backendListener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		line, _ := bufio.NewReader(connection).ReadString('\n')
+		header <- line
+	}()
+
+	poolConfig := loadTestConfig(t, map[string]string{"LB_BACKENDS": backendListener.Addr().String(), "LB_HEALTH_TYPE": "none", "LB_METRICS_PORT": "off"})
+	loadBalancer := createLoadBalancer(poolConfig, sharedMetrics(), nil)
+	defer loadBalancer.Stop()
+	listenerConfig := *poolConfig
+	listenerConfig.ProxyProtocolSend = "v1"
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go loadBalancer.handleConnection(context.Background(), server, &listenerConfig)
+
+	select {
+	case line := <-header:
+		if !strings.HasPrefix(line, "PROXY ") {
+			t.Errorf("the backend got %q, want the PROXY header of the listener", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the backend got nothing")
+	}
+}
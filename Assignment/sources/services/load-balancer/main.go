@@ -1,37 +1,136 @@
 package main
 
 import (
+	"context"
 	"log"
+	"maps"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 // entrypoint for the loadbalancer
 func main() {
 
-	config, err := LoadConfig()
+	// one pool and one listener from the environment, or as many as LB_CONFIG_FILE describes
+	topology, err := loadTopology()
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	lb := createLoadBalancer(config)
+	metricsHandler := createMetricsHandler()
+	if topology.MetricsPort != "" {
+		go serveMetrics(topology.MetricsPort)
+	}
 
-	// Start a TCP listener --> layer 4
-	log.Printf("TCP Load Balancer starting on :%s, Algorithm: %s", config.Port, config.Algorithm)
-	listener, err := net.Listen("tcp", ":"+config.Port)
+	// one json record per connection, request or udp flow (LB_ACCESS_LOG)
+	accessLog, err := createAccessLogger(topology.AccessLog)
 	if err != nil {
-		log.Fatalf("Failed to start TCP listener: %v", err)
+		log.Fatalf("Failed to open the access log: %v", err)
 	}
-	defer listener.Close()
+	defer accessLog.Close()
 
-	// Run an infinite loop to accept connections
-	for {
-		connection, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+	// every load balancer we create, stopped at the end
+	var balancers []*LoadBalancer
+	pools := make(map[string]*LoadBalancer)
+	for name, poolConfig := range topology.Pools {
+		log.Printf("Starting pool %s, Algorithm: %s", name, poolConfig.Algorithm)
+		pools[name] = createLoadBalancer(poolConfig, metricsHandler.forPool(name), accessLog)
+		balancers = append(balancers, pools[name])
+	}
+
+	// SIGTERM is what docker sends on a redeploy
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP (or a change of the file when LB_CONFIG_RELOAD_INTERVAL is set) reloads LB_CONFIG_FILE
+	reloader := createConfigReloader(os.Getenv("LB_CONFIG_FILE"), topology, pools)
+	go reloader.Watch(ctx, topology.ReloadInterval)
+
+	// the admin api also sees the pools of LB_SNI_ROUTES, the reloader does not since they don't come from the config file
+	adminPools := maps.Clone(pools)
+
+	var servers []*Server
+	for _, listenerConfig := range topology.Listeners {
+		config := listenerConfig.Config
+		server := createServer(listenerConfig.Name, pools[listenerConfig.Pool], config)
+
+		if config.TLS != nil {
+			// a routed server name goes to a pool of the config file, or to its own pool with the
+			// settings of the listener when it comes from LB_SNI_ROUTES, named <listener>/<server name>
+			routes := make(map[string]*LoadBalancer)
+			for serverName, pool := range listenerConfig.Routes {
+				routes[serverName] = pools[pool]
+			}
+			for serverName, backends := range config.TLS.Routes {
+				poolConfig := *config
+				poolConfig.Backends = backends
+				poolConfig.Discovery = nil
+				name := listenerConfig.Name + "/" + serverName
+				log.Printf("Starting pool %s, Algorithm: %s", name, poolConfig.Algorithm)
+				routes[serverName] = createLoadBalancer(&poolConfig, metricsHandler.forPool(name), accessLog)
+				adminPools[name] = routes[serverName]
+				balancers = append(balancers, routes[serverName])
+			}
+			server.tlsFrontend, err = createTLSFrontend(config.TLS, routes)
+			if err != nil {
+				log.Fatalf("Failed to set up TLS of listener %s: %v", listenerConfig.Name, err)
+			}
+		}
+
+		if server.udpProxy != nil {
+			log.Printf("UDP Load Balancer %s starting on :%s, Pool: %s", listenerConfig.Name, config.Port, listenerConfig.Pool)
+			packetConn, err := net.ListenPacket("udp", ":"+config.Port)
+			if err != nil {
+				log.Fatalf("Failed to start UDP listener: %v", err)
+			}
+			go func() {
+				if err := server.udpProxy.Serve(packetConn); err != nil {
+					log.Fatalf("UDP server failed: %v", err)
+				}
+			}()
+			servers = append(servers, server)
 			continue
 		}
 
-		// Handle each new connection in its own goroutine
-		go lb.handleConnection(connection)
+		// Start a TCP listener --> layer 4
+		log.Printf("TCP Load Balancer %s starting on :%s, Pool: %s", listenerConfig.Name, config.Port, listenerConfig.Pool)
+		listener, err := createListenConfig(config).Listen(context.Background(), "tcp", ":"+config.Port)
+		if err != nil {
+			log.Fatalf("Failed to start TCP listener: %v", err)
+		}
+		go func() {
+			if err := server.Serve(listener); err != nil {
+				log.Fatalf("TCP server failed: %v", err)
+			}
+		}()
+		servers = append(servers, server)
+	}
+
+	// the admin api runs on its own port so it is never exposed through the balanced one
+	if topology.AdminPort != "" {
+		go serveAdmin(topology.AdminPort, adminPools)
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+	// the listeners drain at the same time, so the whole shutdown fits in one grace period
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Shutdown(topology.ShutdownGrace)
+			if server.tlsFrontend != nil {
+				server.tlsFrontend.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, loadBalancer := range balancers {
+		loadBalancer.Stop()
 	}
+	log.Println("Load balancer stopped")
 }
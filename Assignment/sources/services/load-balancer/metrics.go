@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandler is a helper to handle the metrics evolution of the load balancer for us
+// the one of createMetricsHandler is shared by the whole process, a pool uses the one of forPool
+// so its series get the pool label and two pools can balance to the same backend
+type MetricsHandler struct {
+	activeConnections   *prometheus.GaugeVec
+	connectionsTotal    *prometheus.CounterVec
+	dialFailures        *prometheus.CounterVec
+	bytesTotal          *prometheus.CounterVec
+	backendUp           *prometheus.GaugeVec
+	stateTransitions    *prometheus.CounterVec
+	selectionsTotal     *prometheus.CounterVec
+	connectionDuration  prometheus.ObserverVec
+	rejectedConnections *prometheus.CounterVec
+}
+
+// countingReader wraps an io.Reader and adds every byte read to a counter
+type countingReader struct {
+	reader  io.Reader
+	counter prometheus.Counter
+}
+
+// creates a new instance of a MetricsHandler that handles the connection, traffic and health metrics
+func createMetricsHandler() *MetricsHandler {
+
+	metricsHandler := &MetricsHandler{}
+
+	//promauto is a convenience package for Prometheus that automatically registers our metrics.
+	metricsHandler.activeConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_active_connections",
+			Help: "Connections currently forwarded to a backend.",
+		},
+		[]string{"pool", "backend"},
+	)
+
+	metricsHandler.connectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_connections_total",
+			Help: "Total number of connections forwarded to a backend.",
+		},
+		[]string{"pool", "backend"},
+	)
+
+	metricsHandler.dialFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_dial_failures_total",
+			Help: "Total number of failed connection attempts to a backend.",
+		},
+		[]string{"pool", "backend"},
+	)
+
+	// in = client -> backend, out = backend -> client
+	metricsHandler.bytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_bytes_total",
+			Help: "Total number of bytes forwarded, by direction.",
+		},
+		[]string{"pool", "backend", "direction"},
+	)
+
+	metricsHandler.backendUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "lb_backend_up",
+			Help: "1 if the health checker considers the backend UP, 0 otherwise.",
+		},
+		[]string{"pool", "backend"},
+	)
+
+	metricsHandler.stateTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_backend_state_transitions_total",
+			Help: "Total number of health state changes of a backend (up, down, ejected).",
+		},
+		[]string{"pool", "backend", "state"},
+	)
+
+	metricsHandler.selectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_selections_total",
+			Help: "Total number of times a backend was selected, by algorithm.",
+		},
+		[]string{"pool", "algorithm", "backend"},
+	)
+
+	metricsHandler.connectionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lb_connection_duration_seconds",
+			Help:    "Duration of the forwarded connections.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300}, // Buckets in seconds
+		},
+		[]string{"pool", "backend"},
+	)
+
+	// rejected by a listener before any pool is involved, so it is labelled by listener instead
+	metricsHandler.rejectedConnections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lb_rejected_connections_total",
+			Help: "Total number of connections rejected by the connection limits of a listener, by reason.",
+		},
+		[]string{"listener", "reason"},
+	)
+
+	return metricsHandler
+}
+
+// forPool returns the metrics of one pool, the same metrics with the pool label already set
+func (metricsHandler *MetricsHandler) forPool(pool string) *MetricsHandler {
+	labels := prometheus.Labels{"pool": pool}
+	return &MetricsHandler{
+		activeConnections:   metricsHandler.activeConnections.MustCurryWith(labels),
+		connectionsTotal:    metricsHandler.connectionsTotal.MustCurryWith(labels),
+		dialFailures:        metricsHandler.dialFailures.MustCurryWith(labels),
+		bytesTotal:          metricsHandler.bytesTotal.MustCurryWith(labels),
+		backendUp:           metricsHandler.backendUp.MustCurryWith(labels),
+		stateTransitions:    metricsHandler.stateTransitions.MustCurryWith(labels),
+		selectionsTotal:     metricsHandler.selectionsTotal.MustCurryWith(labels),
+		connectionDuration:  metricsHandler.connectionDuration.MustCurryWith(labels),
+		rejectedConnections: metricsHandler.rejectedConnections,
+	}
+}
+
+// start the /metrics endpoint on its own port for prometheus to scrape
+func serveMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Metrics listening on :%s", port)
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
+		log.Printf("Metrics server failed: %v", err)
+	}
+}
+
+// save a health state change of a backend (up, down or ejected)
+func (metricsHandler *MetricsHandler) saveStateChange(backendURL string, state string) {
+	metricsHandler.stateTransitions.WithLabelValues(backendURL, state).Inc()
+	switch state {
+	case "up":
+		metricsHandler.backendUp.WithLabelValues(backendURL).Set(1)
+	case "down":
+		metricsHandler.backendUp.WithLabelValues(backendURL).Set(0)
+	}
+}
+
+// create a reader that counts the bytes going through it in the given direction of a backend
+func (metricsHandler *MetricsHandler) createCountingReader(reader io.Reader, backendURL string, direction string) io.Reader {
+	return &countingReader{
+		reader:  reader,
+		counter: metricsHandler.bytesTotal.WithLabelValues(backendURL, direction),
+	}
+}
+
+// we have to implement the Read method to fullfil the Readers interface
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.counter.Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSaveStateChange(t *testing.T) {
+	metricsHandler := sharedMetrics()
+	backendURL := "metrics-state:5000"
+
+	metricsHandler.saveStateChange(backendURL, "up")
+	metricsHandler.saveStateChange(backendURL, "ejected")
+	if got := testutil.ToFloat64(metricsHandler.backendUp.WithLabelValues(backendURL)); got != 1 {
+		t.Errorf("lb_backend_up = %v after up and ejected, want 1", got)
+	}
+	metricsHandler.saveStateChange(backendURL, "down")
+	if got := testutil.ToFloat64(metricsHandler.backendUp.WithLabelValues(backendURL)); got != 0 {
+		t.Errorf("lb_backend_up = %v after down, want 0", got)
+	}
+	for state, want := range map[string]float64{"up": 1, "down": 1, "ejected": 1} {
+		if got := testutil.ToFloat64(metricsHandler.stateTransitions.WithLabelValues(backendURL, state)); got != want {
+			t.Errorf("lb_backend_state_transitions_total{state=%q} = %v, want %v", state, got, want)
+		}
+	}
+}
+
+// two pools balancing to the same backend have their own series
+func TestMetricsForPool(t *testing.T) {
+	sharedMetrics()
+	backendURL := "metrics-shared:5000"
+
+	testMetrics.forPool("users").connectionsTotal.WithLabelValues(backendURL).Inc()
+	testMetrics.forPool("orders").connectionsTotal.WithLabelValues(backendURL).Add(2)
+	for pool, want := range map[string]float64{"users": 1, "orders": 2} {
+		if got := testutil.ToFloat64(testMetrics.connectionsTotal.WithLabelValues(pool, backendURL)); got != want {
+			t.Errorf("lb_connections_total{pool=%q} = %v, want %v", pool, got, want)
+		}
+	}
+}
+
+// the rejected connections are counted per listener
+func TestRejectedConnectionsListener(t *testing.T) {
+	quietLog(t)
+	server, listener := createTestServer(t, nil)
+	defer listener.Close()
+	server.name = "metrics-rejected"
+	client, connection := net.Pipe()
+	defer client.Close()
+
+	server.reject(connection, "max_conns")
+	if got := testutil.ToFloat64(testMetrics.rejectedConnections.WithLabelValues("metrics-rejected", "max_conns")); got != 1 {
+		t.Errorf("lb_rejected_connections_total{listener=\"metrics-rejected\"} = %v, want 1", got)
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	metricsHandler := sharedMetrics()
+	backendURL := "metrics-bytes:5000"
+
+	reader := metricsHandler.createCountingReader(bytes.NewReader(make([]byte, 10000)), backendURL, "out")
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(metricsHandler.bytesTotal.WithLabelValues(backendURL, "out")); got != 10000 {
+		t.Errorf("lb_bytes_total{direction=out} = %v, want 10000", got)
+	}
+	if got := testutil.ToFloat64(metricsHandler.bytesTotal.WithLabelValues(backendURL, "in")); got != 0 {
+		t.Errorf("lb_bytes_total{direction=in} = %v, want 0", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+// OutlierConfig configures the passive health tracking based on the live traffic
+// a backend that fails ConsecutiveFailures connections in a row is ejected for BaseEjection,
+// every new ejection doubles that period up to MaxEjection
+type OutlierConfig struct {
+	// 0 disables the outlier detection
+	ConsecutiveFailures int
+	BaseEjection        time.Duration
+	MaxEjection         time.Duration
+	// share of the backends of the pool that can be ejected at the same time, one backend can always be ejected
+	// a failure that would go over it is not counted as an ejection, the backend keeps its failures
+	MaxEjectionPercent int
+	// sessions shorter than this during which the backend sent nothing count as failures, 0 disables it
+	ShortSession time.Duration
+}
+
+// outlierState is the passive health state of a backend, protected by the mutex of the Backend
+type outlierState struct {
+	// consecutive failures seen on live connections
+	passiveFailures int
+	// number of ejections in a row, used for the exponential back-off
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// check if a backend is currently ejected by the outlier detection in a threadsafe manner
+func (backend *Backend) IsEjected() bool {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+	return time.Now().Before(backend.outlier.ejectedUntil)
+}
+
+// record a failed connection to the backend, canEject is false when too many backends are already ejected
+// returns the ejection period if this failure got the backend ejected, 0 otherwise
+func (backend *Backend) reportFailure(outlierConfig *OutlierConfig, canEject bool) time.Duration {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	now := time.Now()
+	outlier := &backend.outlier
+	if now.Before(outlier.ejectedUntil) {
+		// already ejected, the connection was selected before the ejection happened
+		return 0
+	}
+
+	outlier.passiveFailures++
+	if outlier.passiveFailures < outlierConfig.ConsecutiveFailures || !canEject {
+		return 0
+	}
+
+	// forget the back-off if the backend behaved for a long time since its last ejection
+	if !outlier.ejectedUntil.IsZero() && now.Sub(outlier.ejectedUntil) > outlierConfig.MaxEjection {
+		outlier.ejections = 0
+	}
+
+	ejection := outlierConfig.BaseEjection
+	for i := 0; i < outlier.ejections && ejection < outlierConfig.MaxEjection; i++ {
+		ejection *= 2
+	}
+	ejection = min(ejection, outlierConfig.MaxEjection)
+
+	outlier.ejections++
+	outlier.passiveFailures = 0
+	outlier.ejectedUntil = now.Add(ejection)
+	return ejection
+}
+
+// record a successful connection to the backend, this resets the consecutive failures
+func (backend *Backend) reportSuccess() {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.outlier.passiveFailures = 0
+}
+
+// ReportFailure tells the outlier detection that a live connection to the backend failed
+func (healthChecker *HealthChecker) ReportFailure(backendURL string, reason string) {
+	outlierConfig := healthChecker.outlierConfig
+	if outlierConfig == nil || outlierConfig.ConsecutiveFailures == 0 {
+		return
+	}
+	backend := healthChecker.getBackend(backendURL)
+	if backend == nil {
+		return
+	}
+	if ejection := backend.reportFailure(outlierConfig, healthChecker.canEject()); ejection > 0 {
+		log.Printf("Outlier detection: Backend %s ejected for %s (%s)", backendURL, ejection, reason)
+		healthChecker.metrics.saveStateChange(backendURL, "ejected")
+	}
+}
+
+// canEject checks if one more backend can be ejected without going over MaxEjectionPercent
+// the count is taken without a lock over the whole pool, two failures at the same time may both get through
+func (healthChecker *HealthChecker) canEject() bool {
+	backends := healthChecker.Backends()
+	ejected := 0
+	for _, backend := range backends {
+		if backend.IsEjected() {
+			ejected++
+		}
+	}
+	return ejected == 0 || (ejected+1)*100 <= healthChecker.outlierConfig.MaxEjectionPercent*len(backends)
+}
+
+// ReportSuccess tells the outlier detection that a live connection to the backend went fine
+func (healthChecker *HealthChecker) ReportSuccess(backendURL string) {
+	outlierConfig := healthChecker.outlierConfig
+	if outlierConfig == nil || outlierConfig.ConsecutiveFailures == 0 {
+		return
+	}
+	if backend := healthChecker.getBackend(backendURL); backend != nil {
+		backend.reportSuccess()
+	}
+}
+
+// check if an error returned by the copy from the source side is a connection reset of the backend
+// the side at fault comes from the direction of the copy (see failedSide): the address of the error can not tell,
+// a spliced copy reports a failed read of the source with the address of the destination
+func isBackendReset(err error, source string) bool {
+	if !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, syscall.EPIPE) {
+		return false
+	}
+	return failedSide(err, source, otherSide(source)) == sideBackend
+}
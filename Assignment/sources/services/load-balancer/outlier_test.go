@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// the ejection periods of a backend failing again every time its ejection ended
+func TestOutlierBackOff(t *testing.T) {
+	outlierConfig := &OutlierConfig{ConsecutiveFailures: 2, BaseEjection: time.Second, MaxEjection: 4 * time.Second, MaxEjectionPercent: 100}
+	backend := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, &HealthCheckConfig{})
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if ejection := backend.reportFailure(outlierConfig, true); ejection != 0 {
+			t.Fatalf("ejection %d: ejected after one failure", i+1)
+		}
+		if ejection := backend.reportFailure(outlierConfig, true); ejection != want {
+			t.Errorf("ejection %d lasts %s, want %s", i+1, ejection, want)
+		}
+		if !backend.IsEjected() {
+			t.Errorf("ejection %d: backend is not ejected", i+1)
+		}
+		// failures of connections selected before the ejection do not extend it
+		if ejection := backend.reportFailure(outlierConfig, true); ejection != 0 {
+			t.Errorf("ejection %d: an ejected backend was ejected again", i+1)
+		}
+		// end of the ejection
+		backend.outlier.ejectedUntil = time.Now().Add(-time.Millisecond)
+	}
+
+	// a backend that behaved for longer than MaxEjection starts over at BaseEjection
+	backend.outlier.ejectedUntil = time.Now().Add(-5 * time.Second)
+	backend.reportFailure(outlierConfig, true)
+	if ejection := backend.reportFailure(outlierConfig, true); ejection != time.Second {
+		t.Errorf("ejection after a long healthy period lasts %s, want 1s", ejection)
+	}
+}
+
+func TestOutlierSuccessResetsFailures(t *testing.T) {
+	outlierConfig := &OutlierConfig{ConsecutiveFailures: 2, BaseEjection: time.Second, MaxEjection: time.Minute, MaxEjectionPercent: 100}
+	backend := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, &HealthCheckConfig{})
+
+	backend.reportFailure(outlierConfig, true)
+	backend.reportSuccess()
+	if ejection := backend.reportFailure(outlierConfig, true); ejection != 0 {
+		t.Errorf("failures separated by a success got the backend ejected for %s", ejection)
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		backends int
+		percent  int
+		want     int
+	}{
+		{backends: 4, percent: 100, want: 4},
+		{backends: 4, percent: 50, want: 2},
+		{backends: 4, percent: 60, want: 2},
+		{backends: 4, percent: 75, want: 3},
+		// one backend can always be ejected
+		{backends: 2, percent: 10, want: 1},
+		{backends: 1, percent: 10, want: 1},
+	}
+	for _, test := range tests {
+		var backendConfigs []BackendConfig
+		for i := range test.backends {
+			backendConfigs = append(backendConfigs, BackendConfig{URL: fmt.Sprintf("user-%d:5000", i+1), Weight: 1})
+		}
+		outlierConfig := &OutlierConfig{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute, MaxEjectionPercent: test.percent}
+		healthChecker := createHealthChecker(backendConfigs, &HealthCheckConfig{}, outlierConfig, 0)
+		healthChecker.metrics = sharedMetrics()
+		quietLog(t)
+
+		for _, backendConfig := range backendConfigs {
+			healthChecker.ReportFailure(backendConfig.URL, "test")
+		}
+		ejected := 0
+		for _, backend := range healthChecker.Backends() {
+			if backend.IsEjected() {
+				ejected++
+			}
+		}
+		if ejected != test.want {
+			t.Errorf("%d backends at %d%%: %d ejected, want %d", test.backends, test.percent, ejected, test.want)
+		}
+	}
+}
+
+func TestIsBackendReset(t *testing.T) {
+	backendAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	clientAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 40000}
+	spliced := func(errno syscall.Errno, destination net.Addr) error {
+		return &net.OpError{Op: "readfrom", Addr: destination, Err: os.NewSyscallError("splice", errno)}
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		err    error
+		want   bool
+	}{
+		{name: "reset by the backend", source: sideBackend, err: &net.OpError{Op: "read", Addr: backendAddr, Err: syscall.ECONNRESET}, want: true},
+		{name: "broken pipe to the backend", source: sideClient, err: &net.OpError{Op: "write", Addr: backendAddr, Err: syscall.EPIPE}, want: true},
+		{name: "reset by the client", source: sideClient, err: &net.OpError{Op: "read", Addr: clientAddr, Err: syscall.ECONNRESET}},
+		{name: "broken pipe to the client", source: sideBackend, err: &net.OpError{Op: "write", Addr: clientAddr, Err: syscall.EPIPE}},
+		{name: "spliced from a backend reset", source: sideBackend, err: spliced(syscall.ECONNRESET, clientAddr), want: true},
+		{name: "spliced to a closed backend", source: sideClient, err: spliced(syscall.EPIPE, backendAddr), want: true},
+		// the address of a spliced copy is the one of the destination, the reset comes from the client
+		{name: "spliced from a client reset", source: sideClient, err: spliced(syscall.ECONNRESET, backendAddr)},
+		{name: "timeout", source: sideBackend, err: &net.OpError{Op: "read", Addr: backendAddr, Err: syscall.ETIMEDOUT}},
+		{name: "not a network error", source: sideBackend, err: errors.New("connection reset")},
+		{name: "no error", source: sideBackend},
+	}
+	for _, test := range tests {
+		if got := isBackendReset(test.err, test.source); got != test.want {
+			t.Errorf("%s: isBackendReset = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
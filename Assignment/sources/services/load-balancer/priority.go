@@ -0,0 +1,64 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"slices"
+)
+
+// priorityBackends keeps the healthy backends of the priority levels that serve the traffic right now
+// the levels are walked from priority 0 up: a level takes all the traffic as long as at least priorityThreshold
+// of its backends are healthy, below that (or when none is) the healthy backends of the next level are added to it
+// the backends in drain or maintenance do not count, taking a backend out by hand does not wake up the backups
+func (healthChecker *HealthChecker) priorityBackends(backends []*Backend) []*Backend {
+	// stable so the backends of a level keep their order for roundrobin
+	slices.SortStableFunc(backends, func(backend *Backend, other *Backend) int {
+		return cmp.Compare(backend.Priority(), other.Priority())
+	})
+
+	var healthy []*Backend
+	var ejected []*Backend
+	level := 0
+	for start := 0; start < len(backends); {
+		level = backends[start].Priority()
+		end := start
+		for end < len(backends) && backends[end].Priority() == level {
+			end++
+		}
+
+		total, levelHealthy := 0, 0
+		var levelEjected []*Backend
+		for _, backend := range backends[start:end] {
+			if backend.Mode() != ModeActive {
+				continue
+			}
+			total++
+			if !backend.IsAlive() {
+				continue
+			}
+			if backend.IsEjected() {
+				levelEjected = append(levelEjected, backend)
+				continue
+			}
+			healthy = append(healthy, backend)
+			levelHealthy++
+		}
+		// the last resort are the ejected backends of the best level that has some
+		if len(ejected) == 0 {
+			ejected = levelEjected
+		}
+
+		if levelHealthy > 0 && float64(levelHealthy) >= healthChecker.priorityThreshold*float64(total) {
+			break
+		}
+		start = end
+	}
+
+	if len(healthy) == 0 {
+		return ejected
+	}
+	if previous := healthChecker.priorityLevel.Swap(int64(level)); previous != int64(level) {
+		log.Printf("Priority: traffic now goes to the backends up to priority %d (was %d)", level, previous)
+	}
+	return healthy
+}
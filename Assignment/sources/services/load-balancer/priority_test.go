@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPriorityBackends(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		// state of the backends that are not healthy: down, drain or ejected
+		states map[string]string
+		want   []string
+	}{
+		{name: "all healthy", want: []string{"a:1", "b:1"}},
+		{name: "one primary down", states: map[string]string{"a:1": "down"}, want: []string{"b:1"}},
+		{name: "primaries down", states: map[string]string{"a:1": "down", "b:1": "down"}, want: []string{"c:1"}},
+		{name: "under the threshold", threshold: 0.6, states: map[string]string{"a:1": "down"}, want: []string{"b:1", "c:1"}},
+		{name: "at the threshold", threshold: 0.5, states: map[string]string{"a:1": "down"}, want: []string{"b:1"}},
+		{name: "walk down two levels", threshold: 1, states: map[string]string{"a:1": "down", "c:1": "down"}, want: []string{"b:1", "d:1"}},
+		{name: "drained backends do not count", threshold: 1, states: map[string]string{"a:1": "drain"}, want: []string{"b:1"}},
+		{name: "ejected backends are skipped", states: map[string]string{"a:1": "ejected", "b:1": "ejected"}, want: []string{"c:1"}},
+		{name: "ejected of the best level as last resort", states: map[string]string{"a:1": "ejected", "b:1": "down", "c:1": "ejected", "d:1": "down"}, want: []string{"a:1"}},
+		{name: "none left", states: map[string]string{"a:1": "down", "b:1": "down", "c:1": "down", "d:1": "down"}},
+	}
+	for _, test := range tests {
+		quietLog(t)
+		backendConfigs, err := parseBackends("c:1@1,a:1,d:1@2,b:1@0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		healthChecker := createHealthChecker(backendConfigs, &HealthCheckConfig{Rise: 1, Fall: 1}, nil, test.threshold)
+		for _, backend := range healthChecker.Backends() {
+			backend.recordProbe(test.states[backend.URL] != "down")
+			switch test.states[backend.URL] {
+			case "drain":
+				backend.SetMode(ModeDrain)
+			case "ejected":
+				backend.outlier.ejectedUntil = time.Now().Add(time.Minute)
+			}
+		}
+
+		var got []string
+		for _, backend := range healthChecker.priorityBackends(healthChecker.Backends()) {
+			got = append(got, backend.URL)
+		}
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: priority backends %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// the backends of a level keep their configured order, roundrobin depends on it
+func TestPriorityBackendsOrder(t *testing.T) {
+	quietLog(t)
+	backendConfigs, err := parseBackends("z:1,backup:1@1,y:1,x:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthChecker := createHealthChecker(backendConfigs, &HealthCheckConfig{Rise: 1, Fall: 1}, nil, 0)
+	for _, backend := range healthChecker.Backends() {
+		backend.recordProbe(true)
+	}
+	var got []string
+	for _, backend := range healthChecker.priorityBackends(healthChecker.Backends()) {
+		got = append(got, backend.URL)
+	}
+	if want := []string{"z:1", "y:1", "x:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("priority backends %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// time a client gets to send its PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// longest possible v1 header, "PROXY TCP6 <ip> <ip> <port> <port>\r\n"
+const proxyV1MaxLength = 107
+
+// first 12 bytes of a v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyConn is a client connection that started with a PROXY protocol header
+// RemoteAddr and LocalAddr return the addresses of the original connection the upstream proxy received
+type proxyConn struct {
+	net.Conn
+	// the header was read through this reader, it may already hold the first bytes of the payload
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// read the PROXY protocol header (v1 or v2) at the start of a connection
+// returns a connection whose addresses are the ones of the original client, the header itself is consumed
+func acceptProxyProtocol(connection net.Conn) (net.Conn, error) {
+	connection.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer connection.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReaderSize(connection, 512)
+	// both versions are at least 12 bytes long ("PROXY UNKNOWN\r\n" is the shortest header)
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	var source, destination net.Addr
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		source, destination, err = readProxyV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		source, destination, err = readProxyV1(reader)
+	default:
+		err = errors.New("connection does not start with a PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	proxied := &proxyConn{
+		Conn:       connection,
+		reader:     reader,
+		remoteAddr: connection.RemoteAddr(),
+		localAddr:  connection.LocalAddr(),
+	}
+	// UNKNOWN (v1) and LOCAL (v2) headers carry no address, we keep the ones of the connection
+	if source != nil {
+		proxied.remoteAddr = source
+		proxied.localAddr = destination
+	}
+	return proxied, nil
+}
+
+// parse a v1 header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		character, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, character)
+		if character == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header is too long or not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	source, err := parseProxyV1Address(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseProxyV1Address(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+// parse the ip and port of a v1 header
+func parseProxyV1Address(ipStr string, portStr string) (net.Addr, error) {
+	ip := net.ParseIP(ipStr)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid address %s:%s in PROXY v1 header", ipStr, portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parse a v2 header: signature, version/command, family/protocol, length and the addresses
+func readProxyV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, errors.New("unsupported PROXY protocol version")
+	}
+	switch versionCommand & 0x0F {
+	case 0x0: // LOCAL: health checks of the upstream proxy, no address
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errors.New("unsupported PROXY v2 command")
+	}
+
+	// 0x11 = TCP over IPv4, 0x21 = TCP over IPv6, anything else carries no usable address
+	var ipLength int
+	switch family {
+	case 0x11:
+		ipLength = net.IPv4len
+	case 0x21:
+		ipLength = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if length < 2*ipLength+4 {
+		return nil, nil, errors.New("PROXY v2 address block is too short")
+	}
+
+	// the TLVs after the addresses are ignored
+	source := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[:ipLength])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[ipLength : 2*ipLength])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:])),
+	}
+	return source, destination, nil
+}
+
+// writeProxyHeader sends the PROXY protocol header describing the client connection to a backend
+func writeProxyHeader(backendConnection net.Conn, version string, source net.Addr, destination net.Addr) error {
+	var header []byte
+	if version == "v2" {
+		header = buildProxyV2Header(source, destination)
+	} else {
+		header = buildProxyV1Header(source, destination)
+	}
+	_, err := backendConnection.Write(header)
+	return err
+}
+
+// build a v1 header, UNKNOWN if the addresses are not both tcp of the same family
+func buildProxyV1Header(source net.Addr, destination net.Addr) []byte {
+	sourceTCP, sourceOK := source.(*net.TCPAddr)
+	destinationTCP, destinationOK := destination.(*net.TCPAddr)
+	if !sourceOK || !destinationOK || (sourceTCP.IP.To4() == nil) != (destinationTCP.IP.To4() == nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if sourceTCP.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, sourceTCP.IP, destinationTCP.IP, sourceTCP.Port, destinationTCP.Port)
+}
+
+// build a v2 header, LOCAL if the addresses are not both tcp of the same family
+func buildProxyV2Header(source net.Addr, destination net.Addr) []byte {
+	header := bytes.Clone(proxyV2Signature)
+
+	sourceTCP, sourceOK := source.(*net.TCPAddr)
+	destinationTCP, destinationOK := destination.(*net.TCPAddr)
+	if !sourceOK || !destinationOK || (sourceTCP.IP.To4() == nil) != (destinationTCP.IP.To4() == nil) {
+		// version 2, LOCAL command, unspecified family, no address
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	family := byte(0x21)
+	sourceIP, destinationIP := sourceTCP.IP.To16(), destinationTCP.IP.To16()
+	if ipv4 := sourceTCP.IP.To4(); ipv4 != nil {
+		family = 0x11
+		sourceIP, destinationIP = ipv4, destinationTCP.IP.To4()
+	}
+
+	// version 2, PROXY command
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(sourceIP)+4))
+	header = append(header, sourceIP...)
+	header = append(header, destinationIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(sourceTCP.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(destinationTCP.Port))
+	return header
+}
+
+// Read reads through the buffered reader first, it may hold payload read together with the header
+func (connection *proxyConn) Read(p []byte) (int, error) {
+	return connection.reader.Read(p)
+}
+
+// RemoteAddr returns the address of the original client
+func (connection *proxyConn) RemoteAddr() net.Addr {
+	return connection.remoteAddr
+}
+
+// LocalAddr returns the address the original client connected to
+func (connection *proxyConn) LocalAddr() net.Addr {
+	return connection.localAddr
+}
+
+// NetConn returns the wrapped connection
+func (connection *proxyConn) NetConn() net.Conn {
+	return connection.Conn
+}
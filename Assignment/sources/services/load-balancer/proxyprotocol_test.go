@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// build a v2 header with the given version/command and family byte around an address block
+func proxyV2Header(versionCommand byte, family byte, addresses []byte) []byte {
+	header := append(bytes.Clone(proxyV2Signature), versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// an IPv4 address block: 10.0.0.1:56324 -> 10.0.0.2:443
+var proxyV2IPv4Addresses = []byte{10, 0, 0, 1, 10, 0, 0, 2, 0xDC, 0x04, 0x01, 0xBB}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	ipv6Addresses := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x01, 0xBB)
+
+	tests := []struct {
+		name  string
+		input []byte
+		// remote address after the header, "pipe" is the one of the connection itself
+		wantRemote string
+		wantLocal  string
+		wantErr    bool
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 56324 443\r\n"), wantRemote: "10.0.0.1:56324", wantLocal: "10.0.0.2:443"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), wantRemote: "[2001:db8::1]:56324", wantLocal: "[2001:db8::2]:443"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n"), wantRemote: "pipe"},
+		{name: "v1 unknown with addresses", input: []byte("PROXY UNKNOWN 10.0.0.1 10.0.0.2 56324 443\r\n"), wantRemote: "pipe"},
+		{name: "v1 without crlf", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 56324 443\n"), wantErr: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 10.0.0.1 10.0"), wantErr: true},
+		{name: "v1 oversized", input: []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"), wantErr: true},
+		{name: "v1 udp", input: []byte("PROXY UDP4 10.0.0.1 10.0.0.2 56324 443\r\n"), wantErr: true},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 56324\r\n"), wantErr: true},
+		{name: "v1 invalid ip", input: []byte("PROXY TCP4 10.0.0.300 10.0.0.2 56324 443\r\n"), wantErr: true},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 65536 443\r\n"), wantErr: true},
+		{name: "v2 tcp4", input: proxyV2Header(0x21, 0x11, proxyV2IPv4Addresses), wantRemote: "10.0.0.1:56324", wantLocal: "10.0.0.2:443"},
+		{name: "v2 tcp6", input: proxyV2Header(0x21, 0x21, ipv6Addresses), wantRemote: "[2001:db8::1]:56324", wantLocal: "[2001:db8::2]:443"},
+		{name: "v2 tcp4 with tlvs", input: proxyV2Header(0x21, 0x11, append(bytes.Clone(proxyV2IPv4Addresses), 0x04, 0x00, 0x01, 0x00)), wantRemote: "10.0.0.1:56324", wantLocal: "10.0.0.2:443"},
+		{name: "v2 local", input: proxyV2Header(0x20, 0x00, nil), wantRemote: "pipe"},
+		{name: "v2 local with addresses", input: proxyV2Header(0x20, 0x11, proxyV2IPv4Addresses), wantRemote: "pipe"},
+		{name: "v2 unspecified family", input: proxyV2Header(0x21, 0x00, nil), wantRemote: "pipe"},
+		{name: "v2 unix socket", input: proxyV2Header(0x21, 0x31, make([]byte, 216)), wantRemote: "pipe"},
+		{name: "v2 udp over ipv4", input: proxyV2Header(0x21, 0x12, proxyV2IPv4Addresses), wantRemote: "pipe"},
+		{name: "v2 address block too short", input: proxyV2Header(0x21, 0x11, proxyV2IPv4Addresses[:8]), wantErr: true},
+		{name: "v2 truncated addresses", input: proxyV2Header(0x21, 0x11, proxyV2IPv4Addresses)[:20], wantErr: true},
+		{name: "v2 truncated header", input: proxyV2Header(0x21, 0x11, nil)[:14], wantErr: true},
+		{name: "v2 version 1", input: proxyV2Header(0x11, 0x11, proxyV2IPv4Addresses), wantErr: true},
+		{name: "v2 unknown command", input: proxyV2Header(0x22, 0x11, proxyV2IPv4Addresses), wantErr: true},
+		{name: "no header", input: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+		{name: "too short", input: []byte("PROXY"), wantErr: true},
+		{name: "empty", input: nil, wantErr: true},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(test.input)
+			client.Write([]byte("payload"))
+			client.Close()
+		}()
+
+		proxied, err := acceptProxyProtocol(server)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			server.Close()
+			continue
+		}
+		if err != nil {
+			server.Close()
+			continue
+		}
+		if got := proxied.RemoteAddr().String(); got != test.wantRemote {
+			t.Errorf("%s: remote address = %s, want %s", test.name, got, test.wantRemote)
+		}
+		if got := proxied.LocalAddr().String(); test.wantLocal != "" && got != test.wantLocal {
+			t.Errorf("%s: local address = %s, want %s", test.name, got, test.wantLocal)
+		}
+		// the header is consumed, the payload is left whole
+		if payload, _ := io.ReadAll(proxied); string(payload) != "payload" {
+			t.Errorf("%s: payload after the header = %q", test.name, payload)
+		}
+		proxied.Close()
+	}
+}
+
+// the headers we send are read back to the same addresses
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 56324}
+	destination := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}
+	ipv6Destination := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		version     string
+		destination net.Addr
+		wantRemote  string
+	}{
+		{version: "v1", destination: destination, wantRemote: "10.0.0.1:56324"},
+		{version: "v2", destination: destination, wantRemote: "10.0.0.1:56324"},
+		// mixed families can not be described, UNKNOWN and LOCAL keep the addresses of the connection
+		{version: "v1", destination: ipv6Destination, wantRemote: "pipe"},
+		{version: "v2", destination: ipv6Destination, wantRemote: "pipe"},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			writeProxyHeader(client, test.version, source, test.destination)
+			client.Close()
+		}()
+		proxied, err := acceptProxyProtocol(server)
+		if err != nil {
+			t.Errorf("%s to %s: %v", test.version, test.destination, err)
+			server.Close()
+			continue
+		}
+		if got := proxied.RemoteAddr().String(); got != test.wantRemote {
+			t.Errorf("%s to %s: remote address = %s, want %s", test.version, test.destination, got, test.wantRemote)
+		}
+		proxied.Close()
+	}
+}
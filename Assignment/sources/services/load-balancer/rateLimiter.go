@@ -3,26 +3,161 @@ package main
 import (
 	"context"
 	"io"
+	"sync"
 
 	"golang.org/x/time/rate"
 )
 
-// rateLimitedReader wraps an io.Reader and uses a rate.Limiter to throttle transmission rate.
+// smallest burst we give a limiter, a single read of io.Copy is 32KB
+const minimumBurst = 64 * 1024
+
+// BandwidthConfig holds the bandwidth limits in MB/s, 0 means unlimited
+// up is client -> backend and down is backend -> client
+// every limit is applied at once: per connection, per client IP, per backend and for the whole balancer
+type BandwidthConfig struct {
+	ConnectionUp   float64
+	ConnectionDown float64
+	ClientUp       float64
+	ClientDown     float64
+	BackendUp      float64
+	BackendDown    float64
+	GlobalUp       float64
+	GlobalDown     float64
+}
+
+// rateLimitedReader wraps an io.Reader and uses one or more rate.Limiters to throttle transmission rate.
 type rateLimitedReader struct {
-	reader  io.Reader
-	limiter *rate.Limiter
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*rate.Limiter
+}
+
+// BandwidthLimiter hands out the limiters of a connection
+// the per client and per backend limiters are shared by all the connections of that client or backend,
+// so opening more connections does not give more bandwidth
+type BandwidthLimiter struct {
+	config     *BandwidthConfig
+	globalUp   *rate.Limiter
+	globalDown *rate.Limiter
+	// limiters shared by the connections of a client IP / a backend, removed once their last connection ends
+	mutex    sync.Mutex
+	clients  map[string]*sharedLimiter
+	backends map[string]*sharedLimiter
+}
+
+// sharedLimiter is a pair of limiters used by several connections at once
+type sharedLimiter struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+	// number of connections using it
+	references int
+}
+
+// create the bandwidth limiter of the balancer from the configured limits
+func createBandwidthLimiter(config *BandwidthConfig) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		config:     config,
+		globalUp:   createLimiter(config.GlobalUp),
+		globalDown: createLimiter(config.GlobalDown),
+		clients:    make(map[string]*sharedLimiter),
+		backends:   make(map[string]*sharedLimiter),
+	}
+}
+
+// create a limiter for a rate in MB/s, nil if the rate is unlimited
+func createLimiter(megabytesPerSecond float64) *rate.Limiter {
+	if megabytesPerSecond <= 0 {
+		return nil
+	}
+	// Convert Rate (MB/s) to bytes/second
+	// 1 MB/s = 1024 * 1024 Bytes/s
+	rateInBytes := megabytesPerSecond * 1024 * 1024
+	return rate.NewLimiter(rate.Limit(rateInBytes), max(int(rateInBytes), minimumBurst))
+}
+
+// acquire returns the limiters to apply to a new connection in both directions
+// the per connection rates are the ones of the listener, the shared limiters the ones of the pool
+// release has to be called when the connection ends
+func (bandwidthLimiter *BandwidthLimiter) acquire(clientIP string, backendURL string, listener *BandwidthConfig) (up []*rate.Limiter, down []*rate.Limiter, release func()) {
+	config := bandwidthLimiter.config
+
+	bandwidthLimiter.mutex.Lock()
+	client := bandwidthLimiter.reference(bandwidthLimiter.clients, clientIP, config.ClientUp, config.ClientDown)
+	backend := bandwidthLimiter.reference(bandwidthLimiter.backends, backendURL, config.BackendUp, config.BackendDown)
+	bandwidthLimiter.mutex.Unlock()
+
+	up = appendLimiters(nil, createLimiter(listener.ConnectionUp), client.up, backend.up, bandwidthLimiter.globalUp)
+	down = appendLimiters(nil, createLimiter(listener.ConnectionDown), client.down, backend.down, bandwidthLimiter.globalDown)
+
+	release = func() {
+		bandwidthLimiter.mutex.Lock()
+		defer bandwidthLimiter.mutex.Unlock()
+		bandwidthLimiter.dereference(bandwidthLimiter.clients, clientIP)
+		bandwidthLimiter.dereference(bandwidthLimiter.backends, backendURL)
+	}
+	return up, down, release
+}
+
+// take a reference on the shared limiter of a key, creating it if needed (caller holds the mutex)
+func (bandwidthLimiter *BandwidthLimiter) reference(limiters map[string]*sharedLimiter, key string, up float64, down float64) *sharedLimiter {
+	limiter, ok := limiters[key]
+	if !ok {
+		limiter = &sharedLimiter{up: createLimiter(up), down: createLimiter(down)}
+		limiters[key] = limiter
+	}
+	limiter.references++
+	return limiter
+}
+
+// release a reference on the shared limiter of a key, forgetting it when nobody uses it anymore (caller holds the mutex)
+func (bandwidthLimiter *BandwidthLimiter) dereference(limiters map[string]*sharedLimiter, key string) {
+	limiter, ok := limiters[key]
+	if !ok {
+		return
+	}
+	limiter.references--
+	if limiter.references <= 0 {
+		delete(limiters, key)
+	}
+}
+
+// append the limiters that are not nil (unlimited)
+func appendLimiters(limiters []*rate.Limiter, candidates ...*rate.Limiter) []*rate.Limiter {
+	for _, limiter := range candidates {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return limiters
 }
 
 // crete a new rate limiter
-func createRateLimitedReader(reader io.Reader, limiter *rate.Limiter) io.Reader {
-	return &rateLimitedReader{reader: reader, limiter: limiter}
+// without any limiter the reader is returned as is
+func createRateLimitedReader(ctx context.Context, reader io.Reader, limiters []*rate.Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return reader
+	}
+	return &rateLimitedReader{ctx: ctx, reader: reader, limiters: limiters}
 }
 
 // we have to implempent the Read method to fullfil the Readers interface
 func (reader *rateLimitedReader) Read(p []byte) (int, error) {
 	n, err := reader.reader.Read(p)
-	if n > 0 {
-		_ = reader.limiter.WaitN(context.Background(), n)
-	}
+	waitLimiters(reader.ctx, reader.limiters, n)
 	return n, err
 }
+
+// waitLimiters waits until every limiter let n bytes through
+// it gives up when the context is cancelled: the connection is being closed, stop throttling
+func waitLimiters(ctx context.Context, limiters []*rate.Limiter, n int) {
+	for _, limiter := range limiters {
+		// WaitN refuses to wait for more than the burst at once, so we wait chunk by chunk
+		for remaining := n; remaining > 0; {
+			chunk := min(remaining, limiter.Burst())
+			if err := limiter.WaitN(ctx, chunk); err != nil {
+				return
+			}
+			remaining -= chunk
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestLoadBandwidthConfig(t *testing.T) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{"LB_BACKENDS": "user-1:5000", "LB_RATE": "10", "LB_RATE_DOWN": "20", "LB_CLIENT_RATE_UP": "5"})
+	want := BandwidthConfig{ConnectionUp: 10, ConnectionDown: 20, ClientUp: 5}
+	if *config.Bandwidth != want {
+		t.Errorf("bandwidth = %+v, want %+v", *config.Bandwidth, want)
+	}
+
+	values := map[string]string{"LB_BACKENDS": "user-1:5000", "LB_GLOBAL_RATE_UP": "fast"}
+	if _, err := loadConfig(func(key string) string { return values[key] }); err == nil {
+		t.Errorf("LB_GLOBAL_RATE_UP=fast was accepted")
+	}
+}
+
+func TestCreateLimiter(t *testing.T) {
+	if createLimiter(0) != nil || createLimiter(-1) != nil {
+		t.Errorf("an unlimited rate got a limiter")
+	}
+	limiter := createLimiter(2)
+	if limiter.Limit() != 2*1024*1024 || limiter.Burst() != 2*1024*1024 {
+		t.Errorf("2 MB/s = limit %v burst %d", limiter.Limit(), limiter.Burst())
+	}
+	if burst := createLimiter(0.01).Burst(); burst != minimumBurst {
+		t.Errorf("burst of a small rate = %d, want %d", burst, minimumBurst)
+	}
+}
+
+// the connections of a client share its limiter, which is forgotten with the last of them
+func TestBandwidthLimiterShared(t *testing.T) {
+	config := &BandwidthConfig{ConnectionUp: 1, ClientUp: 2, BackendDown: 3, GlobalDown: 4}
+	bandwidthLimiter := createBandwidthLimiter(config)
+
+	firstUp, firstDown, releaseFirst := bandwidthLimiter.acquire("10.0.0.1", "user-1:5000", config)
+	secondUp, secondDown, releaseSecond := bandwidthLimiter.acquire("10.0.0.1", "user-1:5000", config)
+	otherUp, _, releaseOther := bandwidthLimiter.acquire("10.0.0.2", "user-1:5000", config)
+
+	// connection and client limits up, backend and global limits down
+	if len(firstUp) != 2 || len(firstDown) != 2 {
+		t.Fatalf("got %d limiters up and %d down, want 2 and 2", len(firstUp), len(firstDown))
+	}
+	if firstUp[0] == secondUp[0] {
+		t.Errorf("two connections share their per connection limiter")
+	}
+	if firstUp[1] != secondUp[1] {
+		t.Errorf("two connections of a client do not share the client limiter")
+	}
+	if firstUp[1] == otherUp[1] {
+		t.Errorf("two clients share a client limiter")
+	}
+	if firstDown[0] != secondDown[0] || firstDown[1] != secondDown[1] {
+		t.Errorf("two connections to a backend do not share the backend and global limiters")
+	}
+
+	releaseFirst()
+	releaseOther()
+	if bandwidthLimiter.clients["10.0.0.1"] == nil || bandwidthLimiter.clients["10.0.0.2"] != nil {
+		t.Errorf("clients after the first releases = %v", bandwidthLimiter.clients)
+	}
+	releaseSecond()
+	if len(bandwidthLimiter.clients) != 0 || len(bandwidthLimiter.backends) != 0 {
+		t.Errorf("limiters left after the last release: %d clients, %d backends", len(bandwidthLimiter.clients), len(bandwidthLimiter.backends))
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := make([]byte, 30*1024)
+	if _, ok := createRateLimitedReader(context.Background(), bytes.NewReader(data), nil).(*bytes.Reader); !ok {
+		t.Errorf("the reader is wrapped without limiters")
+	}
+
+	// 10KB of burst then 100KB/s: the 20KB after the burst take about 200ms
+	limiter := rate.NewLimiter(100*1024, 10*1024)
+	start := time.Now()
+	read, err := io.Copy(io.Discard, createRateLimitedReader(context.Background(), bytes.NewReader(data), []*rate.Limiter{limiter}))
+	if err != nil || read != int64(len(data)) {
+		t.Fatalf("read %d bytes, %v", read, err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("30KB went through in %s, want about 200ms", elapsed)
+	}
+
+	// a cancelled context stops the throttling, the bytes still go through
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter = rate.NewLimiter(1024, 1024)
+	start = time.Now()
+	read, _ = io.Copy(io.Discard, createRateLimitedReader(ctx, bytes.NewReader(data), []*rate.Limiter{limiter}))
+	if read != int64(len(data)) || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("read %d bytes in %s with a cancelled context", read, time.Since(start))
+	}
+}
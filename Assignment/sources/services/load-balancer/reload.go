@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConfigReloader re-reads LB_CONFIG_FILE on SIGHUP (and when the file changes if polling is enabled)
+// and applies it to the running pools: backends are added, drained or get their new weight, priority and health check override
+// and the algorithm is switched
+// anything else (listeners, new pools, health check or rate settings...) needs a restart
+type ConfigReloader struct {
+	path  string
+	pools map[string]*LoadBalancer
+
+	// the config currently applied, reloads are serialized by the mutex
+	mutex    sync.Mutex
+	topology *Topology
+	modTime  time.Time
+}
+
+// create the reloader of the running topology, path is empty when the config comes from the environment
+func createConfigReloader(path string, topology *Topology, pools map[string]*LoadBalancer) *ConfigReloader {
+	reloader := &ConfigReloader{
+		path:     path,
+		pools:    pools,
+		topology: topology,
+	}
+	if info, err := os.Stat(path); err == nil {
+		reloader.modTime = info.ModTime()
+	}
+	return reloader
+}
+
+// Watch reloads the config on SIGHUP, and every interval if the file changed (0 disables the polling)
+// it returns when ctx is cancelled
+func (reloader *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	// without this handler a SIGHUP would kill the balancer
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	if interval > 0 && reloader.path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if reloader.path == "" {
+				log.Println("SIGHUP ignored: the config comes from the environment, set LB_CONFIG_FILE to reload it")
+				continue
+			}
+			log.Printf("SIGHUP received, reloading %s", reloader.path)
+			reloader.Reload()
+		case <-poll:
+			info, err := os.Stat(reloader.path)
+			if err != nil || info.ModTime().Equal(reloader.modTime) {
+				continue
+			}
+			log.Printf("%s changed, reloading it", reloader.path)
+			reloader.Reload()
+		}
+	}
+}
+
+// Reload reads the config file again and applies it, an invalid file is logged and the running config is kept
+func (reloader *ConfigReloader) Reload() {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if info, err := os.Stat(reloader.path); err == nil {
+		// even an invalid file is not retried until it changes again
+		reloader.modTime = info.ModTime()
+	}
+	topology, err := loadConfigFile(reloader.path)
+	if err != nil {
+		log.Printf("Reload failed, keeping the running config: %v", err)
+		return
+	}
+
+	// only the backends and algorithm of the running pools are applied, everything else keeps the running config
+	// so a change that needs a restart is reported again on every reload until the balancer is restarted
+	applied := *reloader.topology
+	applied.Pools = maps.Clone(reloader.topology.Pools)
+
+	if !sameListeners(topology.Listeners, reloader.topology.Listeners) {
+		log.Println("Reload: the listeners changed, restart the balancer to apply it")
+	}
+	for name := range topology.Pools {
+		if _, ok := reloader.pools[name]; !ok {
+			log.Printf("Reload: pool %s is new, restart the balancer to start it", name)
+		}
+	}
+	for name, loadBalancer := range reloader.pools {
+		newConfig, ok := topology.Pools[name]
+		if !ok {
+			log.Printf("Reload: pool %s is no longer configured, restart the balancer to stop it", name)
+			continue
+		}
+		oldConfig := reloader.topology.Pools[name]
+		loadBalancer.reconfigure(name, oldConfig, newConfig)
+
+		poolConfig := *oldConfig
+		poolConfig.Backends, poolConfig.Algorithm = newConfig.Backends, newConfig.Algorithm
+		applied.Pools[name] = &poolConfig
+	}
+
+	reloader.topology = &applied
+	log.Println("Reload done")
+}
+
+// reconfigure applies the backends and algorithm of a new config of the pool
+// the backends are diffed against the previous config, so the ones added with the admin api are left alone
+func (loadBalancer *LoadBalancer) reconfigure(pool string, oldConfig *Config, newConfig *Config) {
+	if newConfig.Algorithm != oldConfig.Algorithm {
+		loadBalancer.SetAlgorithm(newConfig.Algorithm)
+	}
+
+	oldBackends := make(map[string]BackendConfig)
+	for _, backendConfig := range oldConfig.Backends {
+		oldBackends[backendConfig.URL] = backendConfig
+	}
+	newBackends := make(map[string]bool)
+	for _, backendConfig := range newConfig.Backends {
+		newBackends[backendConfig.URL] = true
+		oldBackend, existed := oldBackends[backendConfig.URL]
+		running := loadBalancer.healthChecker.getBackend(backendConfig.URL)
+
+		switch {
+		case running == nil:
+			loadBalancer.AddBackend(backendConfig)
+		case !existed && running.Mode() == ModeDrain:
+			// removed by an earlier reload and still draining, put it back in rotation
+			running.SetMode(ModeActive)
+			loadBalancer.healthChecker.UpdateBackend(backendConfig)
+		case existed && !reflect.DeepEqual(oldBackend, backendConfig):
+			// new weight, priority or health check override
+			loadBalancer.healthChecker.UpdateBackend(backendConfig)
+		}
+	}
+	for url := range oldBackends {
+		if !newBackends[url] {
+			loadBalancer.DrainBackend(url)
+		}
+	}
+
+	if !sameRestartSettings(oldConfig, newConfig) {
+		log.Printf("Reload: settings of pool %s other than backends and algorithm changed, restart the balancer to apply them", pool)
+	}
+}
+
+// check if two lists of listeners are the same, apart from the settings a reload applies
+func sameListeners(listeners []ListenerConfig, others []ListenerConfig) bool {
+	if len(listeners) != len(others) {
+		return false
+	}
+	for i, listener := range listeners {
+		other := others[i]
+		if listener.Name != other.Name || listener.Pool != other.Pool || !reflect.DeepEqual(listener.Routes, other.Routes) ||
+			!sameRestartSettings(listener.Config, other.Config) {
+			return false
+		}
+	}
+	return true
+}
+
+// check if two configs only differ by their backends and algorithm, the settings a reload applies
+func sameRestartSettings(config *Config, other *Config) bool {
+	settings, otherSettings := *config, *other
+	settings.Backends, otherSettings.Backends = nil, nil
+	settings.Algorithm, otherSettings.Algorithm = "", ""
+	return reflect.DeepEqual(settings, otherSettings)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// every case starts from a pool of user-1 (weight 1) and user-2 (weight 2), applies oldBackends then newBackends
+// and checks the mode and weight of the backends of the pool
+func TestReconfigure(t *testing.T) {
+	type wantBackend struct {
+		mode   string
+		weight int
+	}
+	tests := []struct {
+		name        string
+		oldBackends string
+		newBackends string
+		// run between the two configs
+		before func(loadBalancer *LoadBalancer)
+		want   map[string]wantBackend
+	}{
+		{
+			name:        "add",
+			oldBackends: "user-1:5000,user-2:5000=2",
+			newBackends: "user-1:5000,user-2:5000=2,user-3:5000",
+			want:        map[string]wantBackend{"user-1:5000": {ModeActive, 1}, "user-2:5000": {ModeActive, 2}, "user-3:5000": {ModeActive, 1}},
+		},
+		{
+			name:        "drain removed",
+			oldBackends: "user-1:5000,user-2:5000=2",
+			newBackends: "user-1:5000",
+			want:        map[string]wantBackend{"user-1:5000": {ModeActive, 1}, "user-2:5000": {ModeDrain, 2}},
+		},
+		{
+			name:        "new weight",
+			oldBackends: "user-1:5000,user-2:5000=2",
+			newBackends: "user-1:5000=4,user-2:5000=2",
+			want:        map[string]wantBackend{"user-1:5000": {ModeActive, 4}, "user-2:5000": {ModeActive, 2}},
+		},
+		{
+			name:        "re-activate a backend still draining",
+			oldBackends: "user-1:5000",
+			newBackends: "user-1:5000,user-2:5000=3",
+			before: func(loadBalancer *LoadBalancer) {
+				loadBalancer.DrainBackend("user-2:5000")
+			},
+			want: map[string]wantBackend{"user-1:5000": {ModeActive, 1}, "user-2:5000": {ModeActive, 3}},
+		},
+		{
+			name:        "leave the backends of the admin api alone",
+			oldBackends: "user-1:5000",
+			newBackends: "user-1:5000",
+			before: func(loadBalancer *LoadBalancer) {
+				loadBalancer.AddBackend(BackendConfig{URL: "user-9:5000", Weight: 5})
+			},
+			want: map[string]wantBackend{"user-1:5000": {ModeActive, 1}, "user-2:5000": {ModeActive, 2}, "user-9:5000": {ModeActive, 5}},
+		},
+		{
+			name:        "leave a backend drained by hand",
+			oldBackends: "user-1:5000,user-2:5000=2",
+			newBackends: "user-1:5000,user-2:5000=2",
+			before: func(loadBalancer *LoadBalancer) {
+				loadBalancer.healthChecker.getBackend("user-2:5000").SetMode(ModeDrain)
+			},
+			want: map[string]wantBackend{"user-1:5000": {ModeActive, 1}, "user-2:5000": {ModeDrain, 2}},
+		},
+	}
+	for _, test := range tests {
+		quietLog(t)
+		config := loadTestConfig(t, map[string]string{"LB_BACKENDS": "user-1:5000,user-2:5000=2", "LB_HEALTH_TYPE": "none", "LB_METRICS_PORT": "off"})
+		loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+
+		oldConfig, newConfig := *config, *config
+		oldConfig.Backends, _ = parseBackends(test.oldBackends)
+		newConfig.Backends, _ = parseBackends(test.newBackends)
+		if test.before != nil {
+			test.before(loadBalancer)
+		}
+		loadBalancer.reconfigure("users", &oldConfig, &newConfig)
+
+		backends := loadBalancer.healthChecker.Backends()
+		if len(backends) != len(test.want) {
+			t.Errorf("%s: %d backends, want %d", test.name, len(backends), len(test.want))
+		}
+		for _, backend := range backends {
+			want, ok := test.want[backend.URL]
+			if !ok {
+				t.Errorf("%s: unexpected backend %s", test.name, backend.URL)
+				continue
+			}
+			if backend.Mode() != want.mode || backend.Weight() != want.weight {
+				t.Errorf("%s: backend %s is %s with weight %d, want %s with weight %d", test.name, backend.URL, backend.Mode(), backend.Weight(), want.mode, want.weight)
+			}
+		}
+		loadBalancer.Stop()
+	}
+}
+
+// a new weight keeps the backend, its health state and its running connections
+func TestUpdateBackendInPlace(t *testing.T) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{"LB_BACKENDS": "user-1:5000", "LB_HEALTH_TYPE": "none", "LB_METRICS_PORT": "off"})
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+	defer loadBalancer.Stop()
+
+	backend := loadBalancer.healthChecker.getBackend("user-1:5000")
+	loadBalancer.increment(backend)
+	defer loadBalancer.decrement(backend)
+
+	updated, err := loadBalancer.healthChecker.UpdateBackend(BackendConfig{URL: "user-1:5000", Weight: 3, Priority: 1, HealthCheck: &BackendHealthCheck{Type: "http", Path: "/ready"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != backend || loadBalancer.healthChecker.getBackend("user-1:5000") != backend {
+		t.Fatalf("the backend was replaced")
+	}
+	if backend.Weight() != 3 || backend.Priority() != 1 || backend.activeCheck().Path != "/ready" {
+		t.Errorf("backend has weight %d, priority %d, check %+v", backend.Weight(), backend.Priority(), backend.activeCheck())
+	}
+	if backend.ActiveConnections() != 1 || !backend.IsAlive() {
+		t.Errorf("backend lost its state: %d connections, alive %v", backend.ActiveConnections(), backend.IsAlive())
+	}
+
+	if _, err := loadBalancer.healthChecker.UpdateBackend(BackendConfig{URL: "user-9:5000", Weight: 1}); err == nil {
+		t.Errorf("an unknown backend was updated")
+	}
+}
+
+// a reload applies the backends and keeps the running config for what needs a restart
+func TestReloadKeepsSkippedChanges(t *testing.T) {
+	quietLog(t)
+	path := writeConfigFile(t, `{
+		"settings": {"health_type": "none", "metrics_port": "off"},
+		"pools": {"users": {"backends": ["user-1:5000"], "health_interval": "10s"}},
+		"listeners": [{"name": "users", "port": 8080, "pool": "users"}]
+	}`)
+	topology, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadBalancer := createLoadBalancer(topology.Pools["users"], sharedMetrics(), nil)
+	defer loadBalancer.Stop()
+	reloader := createConfigReloader(path, topology, map[string]*LoadBalancer{"users": loadBalancer})
+
+	// a new backend, a new port and a new health interval: only the backend is applied
+	os.WriteFile(path, []byte(`{
+		"settings": {"health_type": "none", "metrics_port": "off"},
+		"pools": {"users": {"backends": ["user-1:5000", "user-2:5000"], "health_interval": "5s"}},
+		"listeners": [{"name": "users", "port": 9090, "pool": "users"}]
+	}`), 0o600)
+	reloader.Reload()
+
+	if loadBalancer.healthChecker.getBackend("user-2:5000") == nil {
+		t.Errorf("the new backend was not added")
+	}
+	applied := reloader.topology
+	if port := applied.Listeners[0].Config.Port; port != "8080" {
+		t.Errorf("the recorded listener is on port %s, want the running 8080", port)
+	}
+	pool := applied.Pools["users"]
+	if pool.HealthCheck.Interval != 10*time.Second {
+		t.Errorf("the recorded health interval is %s, want the running 10s", pool.HealthCheck.Interval)
+	}
+	if len(pool.Backends) != 2 {
+		t.Errorf("the recorded backends are %v, want the new ones", pool.Backends)
+	}
+	// the skipped changes still differ from the recorded config, so the next reload reports them again
+	if !sameListeners(applied.Listeners, topology.Listeners) {
+		t.Errorf("the running listeners were replaced")
+	}
+}
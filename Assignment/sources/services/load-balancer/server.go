@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server runs the accept loop of a LoadBalancer and keeps track of the sessions it started
+// so that they can be drained when the balancer shuts down
+type Server struct {
+	// name of the listener, labels its rejected connections
+	name         string
+	loadBalancer *LoadBalancer
+	// settings of the listener (PROXY protocol, connection limits, TLS)
+	config *Config
+	// per client IP and global limits on the accepted connections
+	connectionLimiter *ConnectionLimiter
+	// terminates TLS or peeks at the server name and routes to the pool of that name, nil for plain tcp
+	tlsFrontend *TLSFrontend
+	// balances every http request on its own in http mode (LB_MODE=http), nil in tcp mode
+	httpProxy *HTTPProxy
+	// forwards the datagrams in udp mode (LB_MODE=udp), the rest of the Server is then unused
+	udpProxy *UDPProxy
+	// one entry per running handleConnection
+	sessions sync.WaitGroup
+	// cancelled when the grace period is over, it force closes the remaining sessions
+	forceClose       context.Context
+	cancelForceClose context.CancelFunc
+
+	// guards the listener and shuttingDown, a session is only added to sessions under it
+	// so Shutdown can not start waiting between the check of shuttingDown and the Add
+	mutex        sync.Mutex
+	listener     net.Listener
+	shuttingDown bool
+}
+
+// create a server for the load balancer, nothing is accepted until Serve is called
+func createServer(name string, loadBalancer *LoadBalancer, config *Config) *Server {
+	forceClose, cancelForceClose := context.WithCancel(context.Background())
+	server := &Server{
+		name:              name,
+		loadBalancer:      loadBalancer,
+		config:            config,
+		connectionLimiter: createConnectionLimiter(config.ConnectionLimits),
+		forceClose:        forceClose,
+		cancelForceClose:  cancelForceClose,
+	}
+	switch config.Mode {
+	case ListenerModeHTTP:
+		server.httpProxy = createHTTPProxy(config)
+	case ListenerModeUDP:
+		server.udpProxy = createUDPProxy(name, loadBalancer, config)
+	}
+	return server
+}
+
+// Serve accepts connections on the listener until Shutdown is called
+// a listener handed over after Shutdown is closed right away
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	server.listener = listener
+	shuttingDown := server.shuttingDown
+	server.mutex.Unlock()
+	if shuttingDown {
+		listener.Close()
+		return nil
+	}
+
+	// Run an infinite loop to accept connections
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if server.isShuttingDown() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		// Handle each new connection in its own goroutine
+		// the limits are checked there too since a connection may wait in the accept queue
+		if !server.startSession() {
+			connection.Close()
+			return nil
+		}
+		go func() {
+			defer server.sessions.Done()
+			// the PROXY header is read first so the limits below apply to the real client IP
+			if server.config.ProxyProtocolAccept {
+				proxied, err := acceptProxyProtocol(connection)
+				if err != nil {
+					log.Printf("Invalid PROXY header from %s: %v", connection.RemoteAddr(), err)
+					server.reject(connection, RejectProxyHeader)
+					return
+				}
+				connection = proxied
+			}
+			release, reason := server.connectionLimiter.admit(server.forceClose, remoteIP(connection))
+			if reason != "" {
+				server.reject(connection, reason)
+				return
+			}
+			// the slot is given back when the connection is closed, by handleConnection or by the http server in http mode
+			connection = createReleasingConn(connection, release)
+
+			// the handshake costs cpu so it only happens once the connection got through the limits
+			loadBalancer := server.loadBalancer
+			if server.tlsFrontend != nil {
+				tlsConnection, serverName, err := server.tlsFrontend.accept(connection)
+				if err != nil {
+					log.Printf("TLS handshake with %s failed: %v", connection.RemoteAddr(), err)
+					server.reject(connection, RejectTLSHandshake)
+					return
+				}
+				connection = tlsConnection
+				loadBalancer = server.tlsFrontend.route(serverName, loadBalancer)
+			}
+			if server.httpProxy != nil {
+				server.httpProxy.serve(connection, loadBalancer)
+				return
+			}
+			loadBalancer.handleConnection(server.forceClose, connection, server.config)
+		}()
+	}
+}
+
+// startSession adds a session unless the server is shutting down
+func (server *Server) startSession() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.shuttingDown {
+		return false
+	}
+	server.sessions.Add(1)
+	return true
+}
+
+// isShuttingDown reports whether Shutdown was called
+func (server *Server) isShuttingDown() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.shuttingDown
+}
+
+// reject closes a connection that is over one of the connection limits
+func (server *Server) reject(connection net.Conn, reason string) {
+	log.Printf("Rejected connection from %s (%s)", connection.RemoteAddr(), reason)
+	server.loadBalancer.metrics.rejectedConnections.WithLabelValues(server.name, reason).Inc()
+	connection.Close()
+}
+
+// remoteIP returns the IP of the peer of a connection, without the port
+func remoteIP(connection net.Conn) string {
+	ip, _, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		return connection.RemoteAddr().String()
+	}
+	return ip
+}
+
+// Shutdown closes the listener so new connections are refused, then gives the running sessions
+// the grace period to end by themselves before force closing them
+func (server *Server) Shutdown(grace time.Duration) {
+	if server.udpProxy != nil {
+		server.udpProxy.Shutdown(grace)
+		return
+	}
+	server.mutex.Lock()
+	server.shuttingDown = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	server.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.sessions.Wait()
+		close(done)
+	}()
+
+	log.Printf("Draining connections (grace period %s)...", grace)
+	select {
+	case <-done:
+		log.Println("All connections drained")
+	case <-time.After(grace):
+		log.Println("Grace period over, closing the remaining connections")
+		server.cancelForceClose()
+		<-done
+	}
+
+	// in http mode the sessions above only hand the connections over, the requests still run in the http server
+	if server.httpProxy != nil {
+		server.httpProxy.Shutdown(grace)
+	}
+}
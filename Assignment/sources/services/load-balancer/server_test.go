@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// create a server in front of a backend that echoes everything back
+func createTestServer(t *testing.T, values map[string]string) (*Server, net.Listener) {
+	quietLog(t)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			connection, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(connection, connection)
+				connection.Close()
+			}()
+		}
+	}()
+
+	settings := map[string]string{"LB_BACKENDS": backend.Addr().String(), "LB_METRICS_PORT": "off", "LB_HEALTH_RISE": "1"}
+	for key, value := range values {
+		settings[key] = value
+	}
+	config := loadTestConfig(t, settings)
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+	t.Cleanup(loadBalancer.Stop)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return createServer("test", loadBalancer, config), listener
+}
+
+// a SIGTERM that arrives before the accept loop started still closes the listener
+func TestServerShutdownBeforeServe(t *testing.T) {
+	server, listener := createTestServer(t, nil)
+	server.Shutdown(time.Second)
+
+	served := make(chan error)
+	go func() { served <- server.Serve(listener) }()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve kept accepting after Shutdown")
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Errorf("the listener is still open")
+	}
+}
+
+// Shutdown refuses new connections and waits for the running sessions within the grace period
+func TestServerShutdownDrains(t *testing.T) {
+	server, listener := createTestServer(t, nil)
+	served := make(chan error)
+	go func() { served <- server.Serve(listener) }()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, 4)
+	if _, err := io.ReadFull(client, answer); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		server.Shutdown(5 * time.Second)
+		close(shutdown)
+	}()
+	if err := <-served; err != nil {
+		t.Errorf("Serve = %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Errorf("a new connection was accepted during the shutdown")
+	}
+
+	// the running session still works until the client is done
+	if _, err := client.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, answer); err != nil || string(answer) != "pong" {
+		t.Errorf("session answered %q, %v during the grace period", answer, err)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the session ended")
+	default:
+	}
+	client.Close()
+	select {
+	case <-shutdown:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return once the session ended")
+	}
+}
+
+func TestUDPShutdownBeforeServe(t *testing.T) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{"LB_BACKENDS": "127.0.0.1:5000", "LB_MODE": "udp", "LB_HEALTH_TYPE": "none", "LB_METRICS_PORT": "off"})
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), nil)
+	defer loadBalancer.Stop()
+	server := createServer("test", loadBalancer, config)
+	server.Shutdown(time.Second)
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.udpProxy.Serve(packetConn); err != nil {
+		t.Errorf("Serve = %v", err)
+	}
+	if _, _, err := packetConn.ReadFrom(make([]byte, 1)); err == nil {
+		t.Errorf("the socket is still open")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// reasons a tcp session is ended by the balancer, logged when the session closes
+var (
+	errIdleTimeout = errors.New("idle timeout")
+	errMaxLifetime = errors.New("max session lifetime reached")
+)
+
+// sides of a session
+const (
+	sideClient  = "client"
+	sideBackend = "backend"
+)
+
+// otherSide returns the side a direction from the given side goes to
+func otherSide(side string) string {
+	if side == sideBackend {
+		return sideClient
+	}
+	return sideBackend
+}
+
+// sessionError ends a session when one of its sides failed
+type sessionError struct {
+	side string
+	err  error
+}
+
+func (err *sessionError) Error() string { return err.side + ": " + err.err.Error() }
+func (err *sessionError) Unwrap() error { return err.err }
+
+// sessionTermination tells how a session ended for the access log, from the cause of its end
+// and the side that was done first when it ended normally
+func sessionTermination(session context.Context, doneFirst string) string {
+	var sideErr *sessionError
+	cause := context.Cause(session)
+	switch {
+	case cause == nil && doneFirst == sideBackend:
+		return TerminationBackendClosed
+	case cause == nil:
+		return TerminationClientClosed
+	case errors.Is(cause, errIdleTimeout):
+		return TerminationIdleTimeout
+	case errors.Is(cause, errMaxLifetime):
+		return TerminationMaxLifetime
+	case errors.As(cause, &sideErr) && sideErr.side == sideBackend:
+		return TerminationBackendError
+	case errors.As(cause, &sideErr):
+		return TerminationClientError
+	}
+	// forceClose was cancelled
+	return TerminationShutdown
+}
+
+// closeWriter is a connection whose write side can be shut down on its own (tcp, tls)
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes a connection: the peer reads EOF but can still send its answer
+// the wrappers of the balancer (PROXY protocol, replayed ClientHello, connection limits) are unwrapped down to the tcp connection
+// a connection that can not be half-closed is closed
+func closeWrite(connection net.Conn) error {
+	for {
+		switch conn := connection.(type) {
+		case closeWriter:
+			return conn.CloseWrite()
+		case interface{ NetConn() net.Conn }:
+			connection = conn.NetConn()
+		default:
+			return connection.Close()
+		}
+	}
+}
+
+// idleWatcher ends a session once no data went through it in either direction for the timeout
+// the readers of both directions touch it, a single timer checks the last activity instead of resetting a deadline on every read
+type idleWatcher struct {
+	timeout time.Duration
+	// unix nanoseconds of the last read
+	lastActive atomic.Int64
+	timer      *time.Timer
+}
+
+// start watching a session, onIdle is called once when it went idle
+func watchIdle(timeout time.Duration, onIdle func()) *idleWatcher {
+	watcher := &idleWatcher{timeout: timeout}
+	watcher.touch()
+	// the timer is only started once it is assigned, its callback uses it to check again later
+	watcher.timer = time.AfterFunc(math.MaxInt64, func() {
+		idle := time.Since(time.Unix(0, watcher.lastActive.Load()))
+		if idle >= timeout {
+			onIdle()
+			return
+		}
+		watcher.timer.Reset(timeout - idle)
+	})
+	watcher.timer.Reset(timeout)
+	return watcher
+}
+
+// touch records activity on the session
+func (watcher *idleWatcher) touch() {
+	watcher.lastActive.Store(time.Now().UnixNano())
+}
+
+// Stop stops watching the session
+func (watcher *idleWatcher) Stop() {
+	watcher.timer.Stop()
+}
+
+// activityReader touches the idle watcher of its session on every read that returned data
+type activityReader struct {
+	reader  io.Reader
+	watcher *idleWatcher
+}
+
+// wrap a reader of a session, without idle timeout the reader is returned as is
+func createActivityReader(reader io.Reader, watcher *idleWatcher) io.Reader {
+	if watcher == nil {
+		return reader
+	}
+	return &activityReader{reader: reader, watcher: watcher}
+}
+
+func (reader *activityReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.watcher.touch()
+	}
+	return n, err
+}
+
+// create the dialer of the backend connections with the keepalive settings of the balancer
+func createDialer(config *Config) *net.Dialer {
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAliveConfig: config.KeepAlive}
+	if !config.KeepAlive.Enable {
+		dialer.KeepAlive = -1
+	}
+	return dialer
+}
+
+// create the listen config of the client connections with the keepalive settings of the balancer
+func createListenConfig(config *Config) *net.ListenConfig {
+	listenConfig := &net.ListenConfig{KeepAliveConfig: config.KeepAlive}
+	if !config.KeepAlive.Enable {
+		listenConfig.KeepAlive = -1
+	}
+	return listenConfig
+}
+
+// start the session context of a connection, cancelled with its cause when the balancer ends the session early:
+// shutdown grace period over (forceClose), max lifetime reached or a failed direction
+func startSession(forceClose context.Context, maxLifetime time.Duration) (context.Context, context.CancelCauseFunc) {
+	session, endSession := context.WithCancelCause(forceClose)
+	if maxLifetime <= 0 {
+		return session, endSession
+	}
+	session, cancel := context.WithTimeoutCause(session, maxLifetime, errMaxLifetime)
+	return session, func(cause error) {
+		endSession(cause)
+		cancel()
+	}
+}
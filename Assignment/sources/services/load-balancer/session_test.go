@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleWatcher(t *testing.T) {
+	// a timeout shorter than the start of the watcher fires right away
+	fired := make(chan struct{})
+	watcher := watchIdle(time.Nanosecond, func() { close(fired) })
+	defer watcher.Stop()
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("the idle watcher did not fire")
+	}
+
+	// activity pushes the end of the session back
+	idle := make(chan time.Time, 1)
+	start := time.Now()
+	watcher = watchIdle(100*time.Millisecond, func() { idle <- time.Now() })
+	defer watcher.Stop()
+	for range 4 {
+		time.Sleep(50 * time.Millisecond)
+		watcher.touch()
+	}
+	select {
+	case at := <-idle:
+		if at.Sub(start) < 250*time.Millisecond {
+			t.Errorf("the session went idle after %s while it was active", at.Sub(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the idle watcher did not fire once the session was idle")
+	}
+
+	// a stopped watcher does not fire
+	watcher = watchIdle(20*time.Millisecond, func() { t.Error("a stopped idle watcher fired") })
+	watcher.Stop()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestActivityReader(t *testing.T) {
+	watcher := watchIdle(time.Hour, func() {})
+	defer watcher.Stop()
+	watcher.lastActive.Store(0)
+
+	reader := createActivityReader(io.LimitReader(zeroReader{}, 1), watcher)
+	buffer := make([]byte, 8)
+	if _, err := reader.Read(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if watcher.lastActive.Load() == 0 {
+		t.Errorf("a read with data did not touch the watcher")
+	}
+	watcher.lastActive.Store(0)
+	if _, err := reader.Read(buffer); err != io.EOF {
+		t.Fatalf("read = %v, want EOF", err)
+	}
+	if watcher.lastActive.Load() != 0 {
+		t.Errorf("a read without data touched the watcher")
+	}
+
+	if plain := createActivityReader(zeroReader{}, nil); plain != (zeroReader{}) {
+		t.Errorf("without idle timeout the reader is wrapped")
+	}
+}
+
+// zeroReader is an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// closeWrite half-closes a tcp connection even behind the wrappers of the balancer, the peer can still answer
+func TestCloseWrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		request, _ := io.ReadAll(connection)
+		connection.Write(append([]byte("answer to "), request...))
+	}()
+
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := false
+	wrapped := createReleasingConn(connection, func() { released = true })
+	defer wrapped.Close()
+
+	wrapped.Write([]byte("ping"))
+	if err := closeWrite(wrapped); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := io.ReadAll(wrapped)
+	if err != nil || string(answer) != "answer to ping" {
+		t.Errorf("answer %q (%v) after the half-close, want \"answer to ping\"", answer, err)
+	}
+	if released {
+		t.Errorf("the half-close released the slots of the connection")
+	}
+
+	// a connection without half-close is closed
+	client, server := net.Pipe()
+	defer server.Close()
+	closeWrite(client)
+	if _, err := client.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("write after closeWrite of a pipe = %v, want the pipe closed", err)
+	}
+}
+
+func TestStartSession(t *testing.T) {
+	session, endSession := startSession(context.Background(), 20*time.Millisecond)
+	defer endSession(nil)
+	<-session.Done()
+	if cause := context.Cause(session); !errors.Is(cause, errMaxLifetime) {
+		t.Errorf("cause %v, want the max lifetime", cause)
+	}
+
+	forceClose, cancel := context.WithCancel(context.Background())
+	session, endSession = startSession(forceClose, 0)
+	defer endSession(nil)
+	endSession(errIdleTimeout)
+	cancel()
+	if cause := context.Cause(session); !errors.Is(cause, errIdleTimeout) {
+		t.Errorf("cause %v, want the first cause", cause)
+	}
+}
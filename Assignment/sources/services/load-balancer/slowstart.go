@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// share of its weight a backend gets at the very start of its slow start
+const slowStartMinFactor = 0.1
+
+// slowStartFactor returns the fraction of its weight a backend gets right now
+// a backend that just became healthy, was just added or just came back from an ejection starts at slowStartMinFactor
+// and ramps up linearly to its full weight over the window, so a cold replica is not flooded with connections
+// the backends that were up when the balancer started get their full weight right away
+func (backend *Backend) slowStartFactor(window time.Duration) float64 {
+	if window <= 0 {
+		return 1
+	}
+
+	backend.mutex.RLock()
+	since := backend.upSince
+	if backend.outlier.ejectedUntil.After(since) {
+		since = backend.outlier.ejectedUntil
+	}
+	backend.mutex.RUnlock()
+
+	elapsed := time.Since(since)
+	// still ejected (only used as a last resort) or done ramping up
+	if since.IsZero() || elapsed < 0 || elapsed >= window {
+		return 1
+	}
+	return max(slowStartMinFactor, float64(elapsed)/float64(window))
+}
+
+// effectiveWeight is the weight of a backend the algorithms use, its configured weight scaled by its slow start
+func (loadBalancer *LoadBalancer) effectiveWeight(backend *Backend) float64 {
+	return float64(backend.Weight()) * backend.slowStartFactor(loadBalancer.config.SlowStart)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSlowStartFactor(t *testing.T) {
+	tests := []struct {
+		name         string
+		window       time.Duration
+		upSince      time.Duration
+		ejectedUntil time.Duration
+		want         float64
+	}{
+		{name: "disabled", window: 0, upSince: -time.Second, want: 1},
+		{name: "up since the start", window: 10 * time.Second, want: 1},
+		{name: "just up", window: 10 * time.Second, upSince: -time.Millisecond, want: slowStartMinFactor},
+		{name: "half way", window: 10 * time.Second, upSince: -5 * time.Second, want: 0.5},
+		{name: "done", window: 10 * time.Second, upSince: -11 * time.Second, want: 1},
+		{name: "still ejected", window: 10 * time.Second, upSince: -time.Minute, ejectedUntil: time.Minute, want: 1},
+		{name: "back from an ejection", window: 10 * time.Second, upSince: -time.Minute, ejectedUntil: -2 * time.Second, want: 0.2},
+	}
+	for _, test := range tests {
+		backend := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, &HealthCheckConfig{})
+		now := time.Now()
+		if test.upSince != 0 {
+			backend.upSince = now.Add(test.upSince)
+		}
+		if test.ejectedUntil != 0 {
+			backend.outlier.ejectedUntil = now.Add(test.ejectedUntil)
+		}
+		if got := backend.slowStartFactor(test.window); math.Abs(got-test.want) > 0.01 {
+			t.Errorf("%s: factor %.3f, want %.3f", test.name, got, test.want)
+		}
+	}
+}
+
+// the backends up at the start get their full weight, the recovered and added ones ramp up
+func TestSlowStartAfterProbes(t *testing.T) {
+	window := time.Minute
+	backend := createBackend(BackendConfig{URL: "user-1:5000", Weight: 1}, &HealthCheckConfig{Rise: 2, Fall: 1})
+	backend.recordProbe(true)
+	if factor := backend.slowStartFactor(window); factor != 1 {
+		t.Errorf("a backend up at the start has factor %.2f, want 1", factor)
+	}
+
+	backend.recordProbe(false)
+	backend.recordProbe(true)
+	if factor := backend.slowStartFactor(window); factor != 1 {
+		t.Errorf("a backend still down has factor %.2f, want 1", factor)
+	}
+	backend.recordProbe(true)
+	if factor := backend.slowStartFactor(window); factor != slowStartMinFactor {
+		t.Errorf("a recovered backend has factor %.2f, want %.2f", factor, slowStartMinFactor)
+	}
+
+	added := createBackend(BackendConfig{URL: "user-2:5000", Weight: 1}, &HealthCheckConfig{Rise: 2, Fall: 1})
+	added.addedAtRuntime = true
+	added.recordProbe(true)
+	if factor := added.slowStartFactor(window); factor != slowStartMinFactor {
+		t.Errorf("a backend added at runtime has factor %.2f, want %.2f", factor, slowStartMinFactor)
+	}
+}
+
+// a backend half way through its slow start gets half of its share of the weighted algorithms
+func TestSlowStartWeights(t *testing.T) {
+	loadBalancer := &LoadBalancer{config: &Config{SlowStart: 10 * time.Second}, currentWeights: make(map[string]float64)}
+	backends := createTestBackends(t, "warm:1=2,cold:1=2")
+	backends[1].upSince = time.Now().Add(-5 * time.Second)
+
+	if weight := loadBalancer.effectiveWeight(backends[1]); math.Abs(weight-1) > 0.01 {
+		t.Errorf("effective weight %.2f, want 1", weight)
+	}
+
+	counts := make(map[string]int)
+	for range 300 {
+		counts[loadBalancer.weightedRoundRobin(backends).URL]++
+	}
+	if counts["cold:1"] < 95 || counts["cold:1"] > 105 {
+		t.Errorf("weighted roundrobin spread 300 picks as %v, want about 100 for cold:1", counts)
+	}
+
+	// leastconn sees the cold backend as twice as loaded
+	backends[0].activeConnections.Store(4)
+	backends[1].activeConnections.Store(1)
+	if backend := loadBalancer.leastConn(backends); backend.URL != "cold:1" {
+		t.Errorf("leastconn picked %s, want cold:1 with 4 scaled connections against 5", backend.URL)
+	}
+	backends[1].activeConnections.Store(2)
+	if backend := loadBalancer.leastConn(backends); backend.URL != "warm:1" {
+		t.Errorf("leastconn picked %s, want warm:1", backend.URL)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// bytes moved by one splice call, the byte counters are only updated between two calls
+const spliceChunk = 1 << 20
+
+// size of the buffers of the copies that can not be spliced
+const copyBufferSize = 32 * 1024
+
+// buffers of the copies that can not be spliced, one per running direction instead of a new one per connection
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// writerOnly hides the ReadFrom of a connection so io.CopyBuffer uses our pooled buffer instead of allocating its own
+type writerOnly struct {
+	io.Writer
+}
+
+// copyDirection forwards one direction of a session from source to destination and returns the bytes forwarded
+// without bandwidth limit nor idle timeout nothing has to look at the bytes, so between two plain tcp connections
+// the kernel moves them from socket to socket (splice) without copying them through the balancer
+// backend is set for the backend -> client direction, its first byte feeds the latency average of leastresponse
+func (loadBalancer *LoadBalancer) copyDirection(session context.Context, destination net.Conn, source net.Conn, limiters []*rate.Limiter,
+	idle *idleWatcher, backendURL string, direction string, backend *Backend) (int64, error) {
+
+	if len(limiters) == 0 && idle == nil {
+		tcpDestination, tcpSource := spliceable(destination), spliceable(source)
+		if tcpDestination != nil && tcpSource != nil {
+			return spliceCopy(tcpDestination, tcpSource, loadBalancer.metrics.bytesTotal.WithLabelValues(backendURL, direction), backend)
+		}
+	}
+
+	var reader io.Reader = createActivityReader(source, idle)
+	if backend != nil {
+		reader = createFirstByteReader(reader, backend)
+	}
+	reader = createRateLimitedReader(session, loadBalancer.metrics.createCountingReader(reader, backendURL, direction), limiters)
+
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+	return io.CopyBuffer(writerOnly{destination}, reader, *buffer)
+}
+
+// spliceCopy copies between two tcp connections with splice, chunk by chunk so the byte counter keeps moving
+// the first read of the backend direction is a plain one to time the first byte
+func spliceCopy(destination *net.TCPConn, source *net.TCPConn, counter prometheus.Counter, backend *Backend) (int64, error) {
+	var written int64
+	if backend != nil {
+		buffer := copyBuffers.Get().(*[]byte)
+		n, err := createFirstByteReader(source, backend).Read(*buffer)
+		if n > 0 {
+			n, err = destination.Write((*buffer)[:n])
+			written += int64(n)
+			counter.Add(float64(n))
+		}
+		copyBuffers.Put(buffer)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	for {
+		// TCPConn.ReadFrom splices from a tcp connection behind an io.LimitedReader
+		n, err := io.Copy(destination, &io.LimitedReader{R: source, N: spliceChunk})
+		written += n
+		counter.Add(float64(n))
+		if err != nil || n < spliceChunk {
+			return written, err
+		}
+	}
+}
+
+// spliceable returns the tcp connection under a connection when its bytes can be moved without looking at them, nil otherwise
+// the PROXY protocol reader may still hold payload read with the header and TLS has to be decrypted, those are copied
+func spliceable(connection net.Conn) *net.TCPConn {
+	for {
+		switch conn := connection.(type) {
+		case *net.TCPConn:
+			return conn
+		case *releasingConn:
+			connection = conn.Conn
+		case *proxyConn:
+			if conn.reader.Buffered() > 0 {
+				return nil
+			}
+			connection = conn.Conn
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// create a pool of one backend without bandwidth limit nor idle timeout, so its sessions are spliced
+// every connection accepted on the returned address is handled by the pool, done gets a value when a session ended
+func createSpliceTest(t *testing.T, backend string, values map[string]string) (string, *LoadBalancer, *lockedBuffer, chan struct{}) {
+	quietLog(t)
+	settings := map[string]string{"LB_BACKENDS": backend, "LB_RATE": "0", "LB_HEALTH_TYPE": "none", "LB_METRICS_PORT": "off"}
+	for key, value := range values {
+		settings[key] = value
+	}
+	config := loadTestConfig(t, settings)
+	accessLog := &lockedBuffer{}
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), &AccessLogger{writer: accessLog})
+	t.Cleanup(loadBalancer.Stop)
+
+	frontend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { frontend.Close() })
+	done := make(chan struct{}, 1)
+	go func() {
+		for {
+			connection, err := frontend.Accept()
+			if err != nil {
+				return
+			}
+			if spliceable(connection) == nil {
+				t.Errorf("the client connection can not be spliced")
+			}
+			go func() {
+				loadBalancer.handleConnection(context.Background(), connection, config)
+				done <- struct{}{}
+			}()
+		}
+	}()
+	return frontend.Addr().String(), loadBalancer, accessLog, done
+}
+
+// wait for the end of a session
+func waitSession(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end")
+	}
+}
+
+// the bytes go through intact in both directions and a half-close of the client still gets the whole answer
+func TestSpliceSession(t *testing.T) {
+	// the backend only answers once the client is done sending
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		connection, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		request, _ := io.ReadAll(connection)
+		connection.Write(request)
+	}()
+	address, _, accessLog, done := createSpliceTest(t, backend.Addr().String(), nil)
+
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// a few splice chunks
+	payload := make([]byte, 3*spliceChunk+12345)
+	rand.Read(payload)
+	go func() {
+		client.Write(payload)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	answer, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(answer, payload) {
+		t.Errorf("got %d bytes back, want the %d bytes sent", len(answer), len(payload))
+	}
+	waitSession(t, done)
+	if records := accessLog.String(); !strings.Contains(records, `"termination":"client_closed"`) {
+		t.Errorf("access log %s, want a session closed by the client", records)
+	}
+}
+
+// a client that resets its connection does not count against the backend
+func TestSpliceClientReset(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		connection, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		io.Copy(io.Discard, connection)
+	}()
+	address, loadBalancer, accessLog, done := createSpliceTest(t, backend.Addr().String(), map[string]string{"LB_OUTLIER_FAILURES": "1"})
+
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("ping"))
+	// give the data time to be spliced, the reset then comes while the balancer waits for more
+	time.Sleep(50 * time.Millisecond)
+	client.(*net.TCPConn).SetLinger(0)
+	client.Close()
+	waitSession(t, done)
+
+	if records := accessLog.String(); !strings.Contains(records, `"termination":"client_error"`) {
+		t.Errorf("access log %s, want a session ended by a client error", records)
+	}
+	if backend := loadBalancer.healthChecker.getBackend(backend.Addr().String()); backend.IsEjected() {
+		t.Errorf("the reset of the client ejected the backend")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time a client gets to complete the TLS handshake (terminate) or send its ClientHello (passthrough)
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLS modes of the balancer
+const (
+	// the balancer holds the certificate, decrypts and forwards plain tcp to the backends
+	TLSModeTerminate = "terminate"
+	// the balancer only reads the server name of the ClientHello and forwards the encrypted stream as is
+	TLSModePassthrough = "passthrough"
+)
+
+// TLSConfig configures the TLS frontend of the balancer
+type TLSConfig struct {
+	Mode     string
+	CertFile string
+	KeyFile  string
+	// how often the certificate files are checked for changes (terminate mode)
+	ReloadInterval time.Duration
+	// backends of the pool of every server name, the connections without a matching server name go to LB_BACKENDS
+	// a name can be a wildcard like *.example.com that matches one label
+	Routes map[string][]BackendConfig
+}
+
+// TLSFrontend handles the TLS side of the accepted connections and picks the pool matching their server name (SNI)
+type TLSFrontend struct {
+	config *TLSConfig
+	// only used to terminate TLS
+	tlsConfig    *tls.Config
+	certificates *certificateReloader
+	// one load balancer per routed server name
+	routes map[string]*LoadBalancer
+}
+
+// create the TLS frontend, the certificate is loaded right away in terminate mode so a bad one fails the startup
+func createTLSFrontend(config *TLSConfig, routes map[string]*LoadBalancer) (*TLSFrontend, error) {
+	frontend := &TLSFrontend{
+		config: config,
+		routes: routes,
+	}
+	if config.Mode == TLSModeTerminate {
+		certificates, err := createCertificateReloader(config.CertFile, config.KeyFile, config.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		frontend.certificates = certificates
+		frontend.tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.getCertificate,
+		}
+	}
+	return frontend, nil
+}
+
+// accept runs the TLS side of a new connection
+// returns the connection to forward (decrypted in terminate mode, untouched in passthrough) and the server name the client asked for
+func (frontend *TLSFrontend) accept(connection net.Conn) (net.Conn, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+
+	if frontend.config.Mode == TLSModePassthrough {
+		return peekServerName(ctx, connection)
+	}
+
+	tlsConnection := tls.Server(connection, frontend.tlsConfig)
+	if err := tlsConnection.HandshakeContext(ctx); err != nil {
+		return nil, "", err
+	}
+	return tlsConnection, tlsConnection.ConnectionState().ServerName, nil
+}
+
+// route returns the load balancer of the pool serving the server name, the fallback one if no route matches
+func (frontend *TLSFrontend) route(serverName string, fallback *LoadBalancer) *LoadBalancer {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return fallback
+	}
+	if loadBalancer, ok := frontend.routes[serverName]; ok {
+		return loadBalancer
+	}
+	// *.example.com matches api.example.com but not a.b.example.com
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		if loadBalancer, ok := frontend.routes["*."+parent]; ok {
+			return loadBalancer
+		}
+	}
+	return fallback
+}
+
+// Stop stops the certificate reloading, the pools of the routes are stopped by their owner
+func (frontend *TLSFrontend) Stop() {
+	if frontend.certificates != nil {
+		frontend.certificates.Stop()
+	}
+}
+
+// errServerNamePeeked stops the handshake once the ClientHello has been read
+var errServerNamePeeked = errors.New("server name peeked")
+
+// peekServerName reads the ClientHello of a connection without answering it
+// the crypto/tls parser does the work: we start a server handshake on a copy of the stream and abort it
+// as soon as the ClientHello is parsed, then replay the bytes read so far in front of the connection
+func peekServerName(ctx context.Context, connection net.Conn) (net.Conn, string, error) {
+	var serverName string
+	var peeked bytes.Buffer
+	sniffer := tls.Server(readOnlyConn{reader: io.TeeReader(connection, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errServerNamePeeked
+		},
+	})
+
+	deadline, _ := ctx.Deadline()
+	connection.SetReadDeadline(deadline)
+	err := sniffer.HandshakeContext(ctx)
+	connection.SetReadDeadline(time.Time{})
+	if !errors.Is(err, errServerNamePeeked) {
+		return nil, "", fmt.Errorf("failed to read the ClientHello: %w", err)
+	}
+
+	return &replayConn{Conn: connection, reader: io.MultiReader(&peeked, connection)}, serverName, nil
+}
+
+// readOnlyConn is the connection the ClientHello sniffer works on
+// it can only be read, so the sniffer never writes anything (like an alert) to the client
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (connection readOnlyConn) Read(p []byte) (int, error)         { return connection.reader.Read(p) }
+func (connection readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (connection readOnlyConn) Close() error                       { return nil }
+func (connection readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (connection readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (connection readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (connection readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (connection readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn is a connection whose first bytes have already been read, they are replayed before the rest
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read returns the peeked bytes first, then reads from the connection
+func (connection *replayConn) Read(p []byte) (int, error) {
+	return connection.reader.Read(p)
+}
+
+// NetConn returns the wrapped connection
+func (connection *replayConn) NetConn() net.Conn {
+	return connection.Conn
+}
+
+// certificateReloader holds the certificate of the terminate mode and reloads it when its files change
+// so a renewed certificate is picked up without restarting the balancer
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	// modification times of the files the certificate was loaded from
+	certModTime time.Time
+	keyModTime  time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// create the reloader, load the certificate and start watching the files
+func createCertificateReloader(certFile string, keyFile string, interval time.Duration) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	reloader.wg.Add(1)
+	go func() {
+		defer reloader.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-reloader.stop:
+				return
+			case <-ticker.C:
+				// a failed reload (e.g. the key is written after the certificate) keeps the old certificate
+				// and is retried on the next tick since the modification times were not saved
+				if reloaded, err := reloader.reload(); err != nil {
+					log.Printf("Failed to reload the TLS certificate: %v", err)
+				} else if reloaded {
+					log.Printf("Reloaded the TLS certificate from %s", reloader.certFile)
+				}
+			}
+		}
+	}()
+	return reloader, nil
+}
+
+// reload loads the certificate again if one of its files changed
+// returns true when a new certificate is in use
+func (reloader *certificateReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mutex.RLock()
+	unchanged := certInfo.ModTime().Equal(reloader.certModTime) && keyInfo.ModTime().Equal(reloader.keyModTime)
+	reloader.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.certificate = &certificate
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+// getCertificate is the GetCertificate callback of the tls.Config
+func (reloader *certificateReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.certificate, nil
+}
+
+// Stop stops watching the certificate files
+func (reloader *certificateReloader) Stop() {
+	close(reloader.stop)
+	reloader.wg.Wait()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a self signed certificate for the given name and its key as pem files in dir
+func writeTestCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// the server name is read from the ClientHello and the handshake can still be completed by someone else
+func TestPeekServerName(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "api.example.com")
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	handshake := make(chan error, 1)
+	go func() {
+		tlsClient := tls.Client(client, &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true})
+		handshake <- tlsClient.Handshake()
+	}()
+
+	replayed, serverName, err := peekServerName(t.Context(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "api.example.com" {
+		t.Errorf("server name = %q, want api.example.com", serverName)
+	}
+	// the backend of the passthrough mode gets the whole ClientHello
+	tlsServer := tls.Server(replayed, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err := tlsServer.Handshake(); err != nil {
+		t.Fatalf("handshake over the replayed connection: %v", err)
+	}
+	if err := <-handshake; err != nil {
+		t.Errorf("client handshake: %v", err)
+	}
+	replayed.Close()
+}
+
+func TestPeekServerNameNotTLS(t *testing.T) {
+	for _, input := range []string{"GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n", "\x16\x03\x01"} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(input))
+			client.Close()
+		}()
+		if _, _, err := peekServerName(t.Context(), server); err == nil {
+			t.Errorf("peeked a server name in %q", input)
+		}
+		server.Close()
+	}
+}
+
+// a ClientHello without server name goes to the default pool
+func TestPeekServerNameWithoutSNI(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	}()
+	_, serverName, err := peekServerName(t.Context(), server)
+	if err != nil || serverName != "" {
+		t.Errorf("peekServerName = %q, %v, want no server name", serverName, err)
+	}
+	client.Close()
+}
+
+func TestTLSFrontendRoute(t *testing.T) {
+	fallback, api, wildcard := &LoadBalancer{}, &LoadBalancer{}, &LoadBalancer{}
+	frontend := &TLSFrontend{routes: map[string]*LoadBalancer{"api.example.com": api, "*.posts.example.com": wildcard}}
+
+	tests := []struct {
+		serverName string
+		want       *LoadBalancer
+	}{
+		{serverName: "api.example.com", want: api},
+		{serverName: "API.Example.com.", want: api},
+		{serverName: "eu.posts.example.com", want: wildcard},
+		{serverName: "a.eu.posts.example.com", want: fallback},
+		{serverName: "posts.example.com", want: fallback},
+		{serverName: "other.example.com", want: fallback},
+		{serverName: "", want: fallback},
+	}
+	for _, test := range tests {
+		if got := frontend.route(test.serverName, fallback); got != test.want {
+			t.Errorf("route(%q) picked the wrong pool", test.serverName)
+		}
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	quietLog(t)
+	config := loadTestConfig(t, map[string]string{
+		"LB_BACKENDS":   "user-1:5000",
+		"LB_TLS_MODE":   "passthrough",
+		"LB_SNI_ROUTES": "API.example.com=api-1:5000,api-2:5000=2; *.posts.example.com=post-1:5000",
+	})
+	if len(config.TLS.Routes) != 2 || len(config.TLS.Routes["api.example.com"]) != 2 || config.TLS.Routes["api.example.com"][1].Weight != 2 {
+		t.Errorf("routes = %v", config.TLS.Routes)
+	}
+
+	for _, values := range []map[string]string{
+		{"LB_SNI_ROUTES": "api.example.com=api-1:5000"},
+		{"LB_TLS_MODE": "offload"},
+		{"LB_TLS_MODE": "terminate"},
+		{"LB_TLS_MODE": "passthrough", "LB_SNI_ROUTES": "api.example.com"},
+		{"LB_TLS_MODE": "passthrough", "LB_SNI_ROUTES": "=api-1:5000"},
+		{"LB_TLS_MODE": "passthrough", "LB_SNI_ROUTES": "api.example.com=api-1"},
+	} {
+		values["LB_BACKENDS"] = "user-1:5000"
+		if _, err := loadConfig(func(key string) string { return values[key] }); err == nil {
+			t.Errorf("TLS settings %v were accepted", values)
+		}
+	}
+}
+
+// a renewed certificate is served once its files changed
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "old.example.com")
+	reloader, err := createCertificateReloader(certFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Stop()
+
+	if reloaded, err := reloader.reload(); reloaded || err != nil {
+		t.Errorf("reload of unchanged files = %v, %v", reloaded, err)
+	}
+
+	writeTestCertificate(t, dir, "new.example.com")
+	// make sure the modification times differ even on coarse file systems
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if reloaded, err := reloader.reload(); !reloaded || err != nil {
+		t.Fatalf("reload of renewed files = %v, %v", reloaded, err)
+	}
+	certificate, _ := reloader.getCertificate(nil)
+	if certificate.Leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("serving the certificate of %s after the renewal", certificate.Leaf.Subject.CommonName)
+	}
+
+	// a broken key keeps the certificate in use
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := reloader.reload(); err == nil {
+		t.Errorf("a broken key was loaded")
+	}
+	if current, _ := reloader.getCertificate(nil); current != certificate {
+		t.Errorf("a failed reload replaced the certificate")
+	}
+}
+
+// the terminate mode decrypts the stream and reports the server name
+func TestTLSFrontendTerminate(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "api.example.com")
+	frontend, err := createTLSFrontend(&TLSConfig{Mode: TLSModeTerminate, CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer frontend.Stop()
+
+	client, server := net.Pipe()
+	go func() {
+		tlsClient := tls.Client(client, &tls.Config{ServerName: "api.example.com", InsecureSkipVerify: true})
+		tlsClient.Write([]byte("hello"))
+		tlsClient.Close()
+	}()
+	connection, serverName, err := frontend.accept(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	if serverName != "api.example.com" {
+		t.Errorf("server name = %q", serverName)
+	}
+	if data, _ := io.ReadAll(connection); string(data) != "hello" {
+		t.Errorf("decrypted %q, want hello", data)
+	}
+}
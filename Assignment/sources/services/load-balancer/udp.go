@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// biggest payload of a udp datagram
+const maxDatagramSize = 65535
+
+// UDPProxy is the udp mode of a listener (LB_MODE=udp)
+// there are no connections in udp so the balancer tracks flows: the first datagram of a client address
+// picks a backend with the algorithm and the following ones go to the same backend until the flow is idle for IdleTimeout
+// every flow has its own socket to the backend, so the answers of the backend are sent back to the right client
+type UDPProxy struct {
+	// name of the listener, labels its rejected flows
+	name         string
+	loadBalancer *LoadBalancer
+	// the per IP and global limits apply to the flows (the accept queue is not supported)
+	connectionLimiter *ConnectionLimiter
+	idleTimeout       time.Duration
+
+	// running flows by client address, the mutex also guards the listener that Serve sets and Shutdown closes
+	// and the shutdown flag, so no flow is added to wg once Shutdown waits for it
+	mutex        sync.Mutex
+	flows        map[string]*udpFlow
+	listener     net.PacketConn
+	shuttingDown bool
+	// one entry per running flow
+	wg sync.WaitGroup
+}
+
+// udpFlow is the datagrams of one client address forwarded to one backend
+type udpFlow struct {
+	clientAddr        net.Addr
+	backend           *Backend
+	backendConnection *net.UDPConn
+	release           func()
+	startTime         time.Time
+	// unix nanoseconds of the last datagram in either direction
+	lastActive atomic.Int64
+	// payload bytes of the client and of the backend, for the access log
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	record    *accessRecord
+	closeOnce sync.Once
+}
+
+// create the udp proxy of a listener, nothing is forwarded until Serve is called
+func createUDPProxy(name string, loadBalancer *LoadBalancer, config *Config) *UDPProxy {
+	return &UDPProxy{
+		name:              name,
+		loadBalancer:      loadBalancer,
+		connectionLimiter: createConnectionLimiter(config.ConnectionLimits),
+		idleTimeout:       config.UDPIdleTimeout,
+		flows:             make(map[string]*udpFlow),
+	}
+}
+
+// Serve reads the datagrams of the clients and forwards them until Shutdown is called
+// a listener handed over after Shutdown is closed right away
+func (udpProxy *UDPProxy) Serve(listener net.PacketConn) error {
+	udpProxy.mutex.Lock()
+	udpProxy.listener = listener
+	shuttingDown := udpProxy.shuttingDown
+	udpProxy.mutex.Unlock()
+	if shuttingDown {
+		listener.Close()
+		return nil
+	}
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, clientAddr, err := listener.ReadFrom(buffer)
+		if err != nil {
+			if udpProxy.isShuttingDown() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Failed to read datagram: %v", err)
+			continue
+		}
+
+		udpProxy.forward(clientAddr, buffer[:n])
+	}
+}
+
+// forward sends a datagram of a client to the backend of its flow
+func (udpProxy *UDPProxy) forward(clientAddr net.Addr, datagram []byte) {
+	// a flow that expired right after it was looked up is already closed, the datagram then starts a new one
+	for range 2 {
+		flow := udpProxy.flow(clientAddr)
+		if flow == nil {
+			return
+		}
+		flow.lastActive.Store(time.Now().UnixNano())
+		_, err := flow.backendConnection.Write(datagram)
+		if err == nil {
+			udpProxy.loadBalancer.metrics.bytesTotal.WithLabelValues(flow.backend.URL, "in").Add(float64(len(datagram)))
+			flow.bytesIn.Add(int64(len(datagram)))
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			continue
+		}
+		// the write reports the port unreachable of an earlier datagram
+		log.Printf("Failed to forward datagram from %s to %s: %v", clientAddr, flow.backend.URL, err)
+		udpProxy.loadBalancer.healthChecker.ReportFailure(flow.backend.URL, "send failed")
+		udpProxy.closeFlow(flow, TerminationBackendError)
+		return
+	}
+}
+
+// flow returns the flow of a client address, a new one is started for a new client
+// returns nil when the datagram has to be dropped (limits, no healthy backend, shutting down)
+func (udpProxy *UDPProxy) flow(clientAddr net.Addr) *udpFlow {
+	key := clientAddr.String()
+	udpProxy.mutex.Lock()
+	flow, ok := udpProxy.flows[key]
+	udpProxy.mutex.Unlock()
+	if ok {
+		// unlike a tcp session a flow can move: a backend that went down or into maintenance loses its flows
+		if flow.backend.IsAlive() && flow.backend.Mode() != ModeMaintenance {
+			return flow
+		}
+		udpProxy.closeFlow(flow, TerminationBackendDown)
+	}
+	if udpProxy.isShuttingDown() {
+		return nil
+	}
+
+	clientIP := udpClientIP(clientAddr)
+	// without accept queue admit never waits, so the context is never used
+	release, reason := udpProxy.connectionLimiter.admit(context.Background(), clientIP)
+	if reason != "" {
+		log.Printf("Rejected flow from %s (%s)", clientAddr, reason)
+		udpProxy.loadBalancer.metrics.rejectedConnections.WithLabelValues(udpProxy.name, reason).Inc()
+		return nil
+	}
+	record := &accessRecord{
+		Time:     time.Now(),
+		Protocol: ListenerModeUDP,
+		Client:   key,
+		Frontend: udpProxy.listener.LocalAddr().String(),
+	}
+	backend, backendConnection := udpProxy.connectBackend(clientIP, record)
+	if backendConnection == nil {
+		log.Printf("Could not reach a healthy backend for %s. Dropping datagram.", clientAddr)
+		release()
+		record.Termination = TerminationNoBackend
+		udpProxy.loadBalancer.accessLog.write(record)
+		return nil
+	}
+
+	flow = &udpFlow{
+		clientAddr:        clientAddr,
+		backend:           backend,
+		backendConnection: backendConnection,
+		release:           release,
+		startTime:         time.Now(),
+		record:            record,
+	}
+	flow.lastActive.Store(flow.startTime.UnixNano())
+	udpProxy.mutex.Lock()
+	if udpProxy.shuttingDown {
+		// Shutdown started while the backend was picked
+		udpProxy.mutex.Unlock()
+		backendConnection.Close()
+		release()
+		record.Termination = TerminationShutdown
+		udpProxy.loadBalancer.accessLog.write(record)
+		return nil
+	}
+	udpProxy.flows[key] = flow
+	udpProxy.wg.Add(1)
+	udpProxy.mutex.Unlock()
+	udpProxy.loadBalancer.increment(backend)
+
+	go udpProxy.forwardReplies(flow)
+	return flow
+}
+
+// check if Shutdown was called
+func (udpProxy *UDPProxy) isShuttingDown() bool {
+	udpProxy.mutex.Lock()
+	defer udpProxy.mutex.Unlock()
+	return udpProxy.shuttingDown
+}
+
+// connectBackend selects a backend and opens the socket of a flow to it
+// a udp dial sends nothing, it only fails when the address can not be resolved or routed
+func (udpProxy *UDPProxy) connectBackend(clientIP string, record *accessRecord) (*Backend, *net.UDPConn) {
+	loadBalancer := udpProxy.loadBalancer
+	record.Algorithm = loadBalancer.Algorithm()
+	tried := make(map[string]bool)
+	for attempt := 1; attempt <= loadBalancer.config.ConnectAttempts; attempt++ {
+		backend := loadBalancer.selectBackend(clientIP, tried)
+		if backend == nil {
+			return nil, nil
+		}
+		dialStart := time.Now()
+		backendConnection, err := net.DialTimeout("udp", backend.URL, loadBalancer.config.ConnectTimeout)
+		if err == nil {
+			record.Backend = backend.URL
+			record.ConnectMs = milliseconds(time.Since(dialStart))
+			return backend, backendConnection.(*net.UDPConn)
+		}
+		record.Retries = attempt
+
+		log.Printf("Failed to connect to backend %s (attempt %d/%d): %v", backend.URL, attempt, loadBalancer.config.ConnectAttempts, err)
+		loadBalancer.metrics.dialFailures.WithLabelValues(backend.URL).Inc()
+		loadBalancer.healthChecker.ReportFailure(backend.URL, "dial failed")
+		tried[backend.URL] = true
+	}
+	return nil, nil
+}
+
+// forwardReplies sends the datagrams of the backend back to the client of the flow
+// and closes the flow once nothing went through it for the idle timeout
+func (udpProxy *UDPProxy) forwardReplies(flow *udpFlow) {
+	defer udpProxy.wg.Done()
+	termination := TerminationIdleTimeout
+	defer func() { udpProxy.closeFlow(flow, termination) }()
+
+	buffer := make([]byte, maxDatagramSize)
+	answered := false
+	for {
+		lastActive := time.Unix(0, flow.lastActive.Load())
+		if time.Since(lastActive) >= udpProxy.idleTimeout {
+			return
+		}
+		flow.backendConnection.SetReadDeadline(lastActive.Add(udpProxy.idleTimeout))
+
+		n, err := flow.backendConnection.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// the client may have sent something meanwhile, the loop checks it
+				continue
+			}
+			// a flow closed by Shutdown, otherwise the flow was already closed and the termination is not used
+			termination = TerminationShutdown
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				udpProxy.loadBalancer.healthChecker.ReportFailure(flow.backend.URL, "port unreachable")
+				termination = TerminationBackendError
+			} else if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading from backend %s: %v", flow.backend.URL, err)
+				termination = TerminationBackendError
+			}
+			return
+		}
+
+		// the first answer feeds the latency average of leastresponse and shows the backend is alive
+		if !answered {
+			answered = true
+			flow.backend.observeFirstByte(time.Since(flow.startTime))
+			udpProxy.loadBalancer.healthChecker.ReportSuccess(flow.backend.URL)
+		}
+		flow.lastActive.Store(time.Now().UnixNano())
+		if _, err := udpProxy.listener.WriteTo(buffer[:n], flow.clientAddr); err != nil {
+			termination = TerminationShutdown
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Failed to send datagram to %s: %v", flow.clientAddr, err)
+				termination = TerminationClientError
+			}
+			return
+		}
+		udpProxy.loadBalancer.metrics.bytesTotal.WithLabelValues(flow.backend.URL, "out").Add(float64(n))
+		flow.bytesOut.Add(int64(n))
+	}
+}
+
+// closeFlow forgets a flow and releases its backend, only once whatever the number of calls
+// termination is how the flow ended for the access log, the one of the first call is kept
+func (udpProxy *UDPProxy) closeFlow(flow *udpFlow, termination string) {
+	flow.closeOnce.Do(func() {
+		udpProxy.mutex.Lock()
+		if udpProxy.flows[flow.clientAddr.String()] == flow {
+			delete(udpProxy.flows, flow.clientAddr.String())
+		}
+		udpProxy.mutex.Unlock()
+
+		flow.backendConnection.Close()
+		flow.release()
+		udpProxy.loadBalancer.decrement(flow.backend)
+		udpProxy.loadBalancer.metrics.connectionDuration.WithLabelValues(flow.backend.URL).Observe(time.Since(flow.startTime).Seconds())
+		log.Printf("Flow from %s to %s closed", flow.clientAddr, flow.backend.URL)
+
+		flow.record.BytesIn, flow.record.BytesOut = flow.bytesIn.Load(), flow.bytesOut.Load()
+		flow.record.Termination = termination
+		udpProxy.loadBalancer.accessLog.write(flow.record)
+	})
+}
+
+// Shutdown stops starting new flows and gives the running ones the grace period to go idle,
+// then closes the socket and the remaining flows
+func (udpProxy *UDPProxy) Shutdown(grace time.Duration) {
+	udpProxy.mutex.Lock()
+	udpProxy.shuttingDown = true
+	udpProxy.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		udpProxy.wg.Wait()
+		close(done)
+	}()
+
+	log.Printf("Draining flows (grace period %s)...", grace)
+	select {
+	case <-done:
+		log.Println("All flows drained")
+	case <-time.After(grace):
+		log.Println("Grace period over, closing the remaining flows")
+		udpProxy.mutex.Lock()
+		for _, flow := range udpProxy.flows {
+			flow.backendConnection.Close()
+		}
+		udpProxy.mutex.Unlock()
+		<-done
+	}
+	udpProxy.mutex.Lock()
+	if udpProxy.listener != nil {
+		udpProxy.listener.Close()
+	}
+	udpProxy.mutex.Unlock()
+}
+
+// udpClientIP returns the IP of a client address, without the port
+func udpClientIP(clientAddr net.Addr) string {
+	if udpAddr, ok := clientAddr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	return clientAddr.String()
+}
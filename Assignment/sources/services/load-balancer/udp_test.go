@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// start a udp backend that answers every datagram with its name
+func listenUDPBackend(t *testing.T, name string) string {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			_, addr, err := backend.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			backend.WriteTo([]byte(name), addr)
+		}
+	}()
+	return backend.LocalAddr().String()
+}
+
+// send a datagram to the proxy and return the answer
+func exchangeDatagram(t *testing.T, client net.Conn) string {
+	t.Helper()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	answer := make([]byte, 64)
+	n, err := client.Read(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(answer[:n])
+}
+
+// the datagrams of a client address stick to one backend until the flow is idle for LB_UDP_IDLE_TIMEOUT
+func TestUDPFlows(t *testing.T) {
+	quietLog(t)
+	backends := listenUDPBackend(t, "a") + "," + listenUDPBackend(t, "b")
+	config := loadTestConfig(t, map[string]string{
+		"LB_BACKENDS":         backends,
+		"LB_MODE":             ListenerModeUDP,
+		"LB_ALGORITHM":        "roundrobin",
+		"LB_HEALTH_TYPE":      "none",
+		"LB_METRICS_PORT":     "off",
+		"LB_UDP_IDLE_TIMEOUT": "200ms",
+	})
+	accessLog := &lockedBuffer{}
+	loadBalancer := createLoadBalancer(config, sharedMetrics(), &AccessLogger{writer: accessLog})
+	defer loadBalancer.Stop()
+
+	udpProxy := createUDPProxy("test", loadBalancer, config)
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go udpProxy.Serve(listener)
+	defer udpProxy.Shutdown(time.Second)
+
+	first, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	firstBackend := exchangeDatagram(t, first)
+	secondBackend := exchangeDatagram(t, second)
+	if firstBackend == secondBackend {
+		t.Errorf("both clients went to %s, roundrobin should split them", firstBackend)
+	}
+	for range 3 {
+		if got := exchangeDatagram(t, first); got != firstBackend {
+			t.Errorf("the first client moved from %s to %s", firstBackend, got)
+		}
+		if got := exchangeDatagram(t, second); got != secondBackend {
+			t.Errorf("the second client moved from %s to %s", secondBackend, got)
+		}
+	}
+
+	// both flows expire once idle
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		udpProxy.mutex.Lock()
+		flows := len(udpProxy.flows)
+		udpProxy.mutex.Unlock()
+		if flows == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	udpProxy.mutex.Lock()
+	flows := len(udpProxy.flows)
+	udpProxy.mutex.Unlock()
+	if flows != 0 {
+		t.Fatalf("%d flows still running after the idle timeout", flows)
+	}
+	for _, backend := range loadBalancer.healthChecker.Backends() {
+		if backend.ActiveConnections() != 0 {
+			t.Errorf("backend %s still has %d flows", backend.URL, backend.ActiveConnections())
+		}
+	}
+	if records := accessLog.String(); strings.Count(records, `"termination":"idle_timeout"`) != 2 {
+		t.Errorf("access log %s, want two flows ended by the idle timeout", records)
+	}
+
+	// the next datagram starts a new flow
+	if got := exchangeDatagram(t, first); got != "a" && got != "b" {
+		t.Errorf("answer %q after the idle timeout", got)
+	}
+}
+
+// lockedBuffer is an access log the flows can write to while the test reads it
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *lockedBuffer) Write(p []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.Write(p)
+}
+
+func (buffer *lockedBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.String()
+}
@@ -1,27 +1,105 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// BackendConfig is a backend as configured in LB_BACKENDS: host:port with an optional =weight and @priority
+type BackendConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	// 0 is the highest priority, the backends of a higher number are backups (see priority.go)
+	Priority int `json:"priority"`
+	// own health check of the backend, nil uses the check of the pool
+	HealthCheck *BackendHealthCheck `json:"health_check,omitempty"`
+}
+
+// String prints the backend the way it is written in LB_BACKENDS
+func (backend BackendConfig) String() string {
+	str := backend.URL + "=" + strconv.Itoa(backend.Weight)
+	if backend.Priority > 0 {
+		str += "@" + strconv.Itoa(backend.Priority)
+	}
+	return str
+}
+
 type Config struct {
-	Port      string
-	Algorithm string
-	Backends  []string
-	Rate      float64
+	Port string
+	// tcp (layer 4, default), http (layer 7, every request is balanced on its own) or udp (datagrams, see udp.go)
+	Mode string
+	// a udp flow with no datagram in either direction for this long is forgotten
+	UDPIdleTimeout time.Duration
+	// session affinity of the http mode, nil when disabled
+	Affinity *AffinityConfig
+	// port of the admin api, empty disables it
+	AdminPort string
+	// port of the prometheus /metrics endpoint, empty disables it
+	MetricsPort string
+	Algorithm   string
+	Backends    []BackendConfig
+	// adds and drains backends as a dns name resolves to them, nil when disabled
+	Discovery *DiscoveryConfig
+	Bandwidth *BandwidthConfig
+	// consistent hashing flavour of the hashing algorithm: ring, rendezvous or maglev
+	HashMode         string
+	HashVirtualNodes int
+	// time a recovered or new backend takes to ramp up to its full weight, 0 disables the slow start
+	SlowStart time.Duration
+	// fraction of the backends of a priority level that has to be healthy for it to take all the traffic
+	PriorityThreshold float64
+	// number of backends we try to connect to before giving up on a client
+	ConnectAttempts int
+	ConnectTimeout  time.Duration
+	// a tcp session with no data in either direction for this long is closed, 0 disables it
+	IdleTimeout time.Duration
+	// a tcp session is closed after this long whatever its activity, 0 disables it
+	MaxSessionLifetime time.Duration
+	// tcp keepalive probes on the client and backend connections, so dead peers are noticed
+	KeepAlive net.KeepAliveConfig
+	// expect a PROXY protocol header (v1 or v2) on every accepted connection
+	ProxyProtocolAccept bool
+	// PROXY protocol version sent to the backends: v1, v2 or empty for none
+	ProxyProtocolSend string
+	// TLS termination or passthrough with routing on the server name, nil for plain tcp
+	TLS *TLSConfig
+	// limits on the accepted connections
+	ConnectionLimits *ConnectionLimitConfig
+	// time the running sessions get to end on shutdown before they are closed
+	ShutdownGrace time.Duration
+	HealthCheck   *HealthCheckConfig
+	Outlier       *OutlierConfig
 }
 
+// time the running sessions get to end on shutdown when LB_SHUTDOWN_GRACE is not set
+const defaultShutdownGrace = 30 * time.Second
+
+// settings looks up a configuration value by its environment variable name, "" when it is not set
+// it is os.Getenv, or the settings of a pool or listener of the config file (see config.go)
+type settings func(key string) string
+
 // LoadConfig reads and parses configuration from environment variables
 func LoadConfig() (*Config, error) {
+	return loadConfig(os.Getenv)
+}
+
+// loadConfig reads and parses the configuration from the given settings
+func loadConfig(env settings) (*Config, error) {
 
-	port := os.Getenv("LB_PORT")
-	algorithm := os.Getenv("LB_ALGORITHM")
-	backendsStr := os.Getenv("LB_BACKENDS")
-	rateStr := os.Getenv("LB_RATE")
+	port := env("LB_PORT")
+	algorithm := env("LB_ALGORITHM")
+	backendsStr := env("LB_BACKENDS")
+	adminPort := env("LB_ADMIN_PORT")
+	metricsPort := loadMetricsPort(env)
 
 	if port == "" {
 		port = "8080" // default
@@ -33,35 +111,671 @@ func LoadConfig() (*Config, error) {
 		log.Printf("Defaulting to algorithm %s", algorithm)
 	}
 	// Validate algorithm
-	if algorithm != "roundrobin" && algorithm != "leastconn" && algorithm != "hashing" {
-		return nil, errors.New("invalid algorithm: must be roundrobin, leastconn, or hashing")
+	if !isValidAlgorithm(algorithm) {
+		return nil, errors.New("invalid algorithm: must be roundrobin, weighted_roundrobin, leastconn, weighted_leastconn, hashing, p2c or leastresponse")
 	}
 
-	if backendsStr == "" {
+	discovery, err := loadDiscoveryConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// with discovery the static backends are optional
+	var backends []BackendConfig
+	if backendsStr == "" && discovery == nil {
 		return nil, errors.New("LB_BACKENDS environment variable is not set")
 	}
+	if backendsStr != "" {
+		backends, err = parseBackends(backendsStr)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded backends: %v", backends)
+	}
+
+	bandwidth, err := loadBandwidthConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// LB_HASH_MODE: ring (default), rendezvous or maglev
+	// LB_HASH_VNODES: virtual nodes per unit of weight on the ring (default 100)
+	hashMode := env("LB_HASH_MODE")
+	if hashMode == "" {
+		hashMode = "ring"
+	}
+	if hashMode != "ring" && hashMode != "rendezvous" && hashMode != "maglev" {
+		return nil, errors.New("invalid LB_HASH_MODE: must be ring, rendezvous or maglev")
+	}
+	hashVirtualNodes, err := getEnvInt(env, "LB_HASH_VNODES", 100)
+	if err != nil {
+		return nil, err
+	}
+	if hashVirtualNodes < 1 {
+		return nil, errors.New("invalid LB_HASH_VNODES: must be at least 1")
+	}
+
+	// LB_CONNECT_ATTEMPTS: backends tried per client connection (default 3)
+	// LB_CONNECT_TIMEOUT: timeout of a single backend dial (default 2s)
+	connectAttempts, err := getEnvInt(env, "LB_CONNECT_ATTEMPTS", 3)
+	if err != nil {
+		return nil, err
+	}
+	if connectAttempts < 1 {
+		return nil, errors.New("invalid LB_CONNECT_ATTEMPTS: must be at least 1")
+	}
+	connectTimeout, err := getEnvDuration(env, "LB_CONNECT_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if connectTimeout == 0 {
+		return nil, errors.New("invalid LB_CONNECT_TIMEOUT: must be positive")
+	}
+
+	// LB_IDLE_TIMEOUT: a session without data in either direction for this long is closed (default 0, disabled)
+	// LB_MAX_SESSION_LIFETIME: a session is closed after this long (default 0, disabled)
+	idleTimeout, err := getEnvDuration(env, "LB_IDLE_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxSessionLifetime, err := getEnvDuration(env, "LB_MAX_SESSION_LIFETIME", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive, err := loadKeepAliveConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// LB_SLOW_START: window over which a recovered or new backend ramps up to its full weight (default 0, disabled)
+	slowStart, err := getEnvDuration(env, "LB_SLOW_START", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// LB_PRIORITY_THRESHOLD: below this fraction of healthy backends a priority level spills over to the next one
+	// (default 0, the backups only get traffic once every backend of the levels before them is down)
+	priorityThreshold, err := getEnvFloat(env, "LB_PRIORITY_THRESHOLD", 0)
+	if err != nil {
+		return nil, err
+	}
+	if priorityThreshold < 0 || priorityThreshold > 1 {
+		return nil, errors.New("invalid LB_PRIORITY_THRESHOLD: must be between 0 and 1")
+	}
+
+	// LB_SHUTDOWN_GRACE: time the running sessions get to end on SIGTERM (default 30s)
+	shutdownGrace, err := getEnvDuration(env, "LB_SHUTDOWN_GRACE", defaultShutdownGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	// LB_PROXY_PROTOCOL_ACCEPT: true when the balancer sits behind a proxy sending the PROXY protocol (default false)
+	// LB_PROXY_PROTOCOL_SEND: v1 or v2 to send the PROXY protocol to the backends (default none)
+	proxyProtocolAccept := false
+	if value := env("LB_PROXY_PROTOCOL_ACCEPT"); value != "" {
+		if proxyProtocolAccept, err = strconv.ParseBool(value); err != nil {
+			return nil, errors.New("invalid LB_PROXY_PROTOCOL_ACCEPT: must be true or false")
+		}
+	}
+	proxyProtocolSend := strings.ToLower(env("LB_PROXY_PROTOCOL_SEND"))
+	if proxyProtocolSend != "" && proxyProtocolSend != "v1" && proxyProtocolSend != "v2" {
+		return nil, errors.New("invalid LB_PROXY_PROTOCOL_SEND: must be v1 or v2")
+	}
+
+	tlsConfig, err := loadTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// LB_MODE: tcp (default), http or udp
+	mode := strings.ToLower(env("LB_MODE"))
+	if mode == "" {
+		mode = ListenerModeTCP
+	}
+	if mode != ListenerModeTCP && mode != ListenerModeHTTP && mode != ListenerModeUDP {
+		return nil, errors.New("invalid LB_MODE: must be tcp, http or udp")
+	}
+	if mode == ListenerModeHTTP && (proxyProtocolSend != "" || (tlsConfig != nil && tlsConfig.Mode == TLSModePassthrough)) {
+		return nil, errors.New("LB_MODE=http works neither with LB_PROXY_PROTOCOL_SEND nor with LB_TLS_MODE=passthrough")
+	}
+	if mode == ListenerModeUDP && (proxyProtocolAccept || proxyProtocolSend != "" || tlsConfig != nil) {
+		return nil, errors.New("LB_MODE=udp works neither with the PROXY protocol nor with TLS")
+	}
+	// the datagrams are forwarded one by one, the bandwidth limits only apply to tcp and http
+	if mode == ListenerModeUDP {
+		for _, key := range bandwidthSettings {
+			if env(key) != "" {
+				return nil, fmt.Errorf("LB_MODE=udp does not support the bandwidth limits, unset %s", key)
+			}
+		}
+	}
+
+	// LB_UDP_IDLE_TIMEOUT: a udp flow without datagrams for this long is closed (default 30s)
+	udpIdleTimeout, err := getEnvDuration(env, "LB_UDP_IDLE_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if udpIdleTimeout == 0 {
+		return nil, errors.New("invalid LB_UDP_IDLE_TIMEOUT: must be positive")
+	}
+
+	// LB_AFFINITY_HEADER: requests with the same value of this header go to the same backend (http mode)
+	// LB_AFFINITY_COOKIE: name of the cookie inserted to pin a client to its backend (http mode)
+	var affinity *AffinityConfig
+	if header, cookie := env("LB_AFFINITY_HEADER"), env("LB_AFFINITY_COOKIE"); header != "" || cookie != "" {
+		if mode != ListenerModeHTTP {
+			return nil, errors.New("LB_AFFINITY_HEADER and LB_AFFINITY_COOKIE need LB_MODE=http")
+		}
+		affinity = &AffinityConfig{Header: header, Cookie: cookie}
+	}
+
+	connectionLimits, err := loadConnectionLimitConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	// the datagrams are read by a single loop that can not wait for a free slot
+	if mode == ListenerModeUDP && connectionLimits.QueueSize > 0 {
+		return nil, errors.New("LB_ACCEPT_QUEUE does not work with LB_MODE=udp")
+	}
+
+	healthCheck, err := loadHealthCheckConfig(env, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadBackendHealthChecks(env, backends, healthCheck); err != nil {
+		return nil, err
+	}
+
+	outlier, err := loadOutlierConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		Port:                port,
+		Mode:                mode,
+		UDPIdleTimeout:      udpIdleTimeout,
+		Affinity:            affinity,
+		AdminPort:           adminPort,
+		MetricsPort:         metricsPort,
+		Algorithm:           algorithm,
+		Backends:            backends,
+		Discovery:           discovery,
+		Bandwidth:           bandwidth,
+		HashMode:            hashMode,
+		HashVirtualNodes:    hashVirtualNodes,
+		ConnectAttempts:     connectAttempts,
+		ConnectTimeout:      connectTimeout,
+		IdleTimeout:         idleTimeout,
+		MaxSessionLifetime:  maxSessionLifetime,
+		KeepAlive:           keepAlive,
+		SlowStart:           slowStart,
+		PriorityThreshold:   priorityThreshold,
+		ShutdownGrace:       shutdownGrace,
+		ProxyProtocolAccept: proxyProtocolAccept,
+		ProxyProtocolSend:   proxyProtocolSend,
+		TLS:                 tlsConfig,
+		ConnectionLimits:    connectionLimits,
+		HealthCheck:         healthCheck,
+		Outlier:             outlier,
+	}
+
+	return cfg, nil
+}
+
+// LB_DISCOVERY_DNS: dns name resolved into backends, e.g. user-service (default none, disabled)
+// LB_DISCOVERY_TYPE: a (A and AAAA records, default) or srv (LB_DISCOVERY_DNS is then an SRV name like _http._tcp.user-service)
+// LB_DISCOVERY_PORT: port of the backends found with A/AAAA records, required for type a
+// LB_DISCOVERY_INTERVAL: time between two lookups (default 10s)
+// LB_DISCOVERY_SERVER: dns server to ask as host:port (default the resolver of the system)
+func loadDiscoveryConfig(env settings) (*DiscoveryConfig, error) {
+	name := env("LB_DISCOVERY_DNS")
+	if name == "" {
+		return nil, nil
+	}
+	discoveryType := strings.ToLower(env("LB_DISCOVERY_TYPE"))
+	if discoveryType == "" {
+		discoveryType = DiscoveryTypeA
+	}
+	if discoveryType != DiscoveryTypeA && discoveryType != DiscoveryTypeSRV {
+		return nil, errors.New("invalid LB_DISCOVERY_TYPE: must be a or srv")
+	}
+	port := env("LB_DISCOVERY_PORT")
+	if discoveryType == DiscoveryTypeA {
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			return nil, errors.New("invalid LB_DISCOVERY_PORT: must be a port number")
+		}
+	}
+	interval, err := getEnvDuration(env, "LB_DISCOVERY_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		return nil, errors.New("invalid LB_DISCOVERY_INTERVAL: must be positive")
+	}
+	server := env("LB_DISCOVERY_SERVER")
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("invalid LB_DISCOVERY_SERVER: %w", err)
+		}
+	}
+	return &DiscoveryConfig{Name: name, Type: discoveryType, Port: port, Interval: interval, Server: server}, nil
+}
+
+// LB_METRICS_PORT: port of the /metrics endpoint (default 9100, off disables it)
+func loadMetricsPort(env settings) string {
+	metricsPort := env("LB_METRICS_PORT")
+	if metricsPort == "" {
+		metricsPort = "9100" // default
+	} else if metricsPort == "off" {
+		metricsPort = ""
+	}
+	return metricsPort
+}
+
+// check if the algorithm is one the load balancer implements
+func isValidAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "roundrobin", "weighted_roundrobin", "leastconn", "weighted_leastconn", "hashing", "p2c", "leastresponse":
+		return true
+	}
+	return false
+}
 
-	backends := strings.Split(backendsStr, ",")
+// parse a comma separated list of backends like "user-service-1:5000=3,user-service-2:5000,user-backup:5000@1"
+// the weight after '=' is optional and defaults to 1, the priority after '@' is optional and defaults to 0
+func parseBackends(backendsStr string) ([]BackendConfig, error) {
+	var backends []BackendConfig
+	for _, entry := range strings.Split(backendsStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		weighted, priorityStr, hasPriority := strings.Cut(entry, "@")
+		url, weightStr, hasWeight := strings.Cut(weighted, "=")
+		backend := BackendConfig{URL: url, Weight: 1}
+		if hasPriority {
+			priority, err := strconv.Atoi(priorityStr)
+			if err != nil || priority < 0 {
+				return nil, fmt.Errorf("invalid priority in LB_BACKENDS entry %q: must be a positive integer or 0", entry)
+			}
+			backend.Priority = priority
+		}
+		if hasWeight {
+			weight, err := strconv.Atoi(weightStr)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight in LB_BACKENDS entry %q: must be a positive integer", entry)
+			}
+			backend.Weight = weight
+		}
+		if _, _, err := net.SplitHostPort(backend.URL); err != nil {
+			return nil, fmt.Errorf("invalid backend %q: must be host:port", backend.URL)
+		}
+		backends = append(backends, backend)
+	}
 	if len(backends) == 0 {
 		return nil, errors.New("no backends provided")
 	}
-	log.Printf("Loaded backends: %v", backends)
+	return backends, nil
+}
+
+// bandwidthSettings are the variables of the bandwidth limits
+var bandwidthSettings = []string{
+	"LB_RATE", "LB_RATE_UP", "LB_RATE_DOWN",
+	"LB_CLIENT_RATE_UP", "LB_CLIENT_RATE_DOWN",
+	"LB_BACKEND_RATE_UP", "LB_BACKEND_RATE_DOWN",
+	"LB_GLOBAL_RATE_UP", "LB_GLOBAL_RATE_DOWN",
+}
 
-	var rate float64 = 100.0 // Default 100 MB/s
-	if rateStr != "" {
-		var err error
-		rate, err = strconv.ParseFloat(rateStr, 64)
+// loadBandwidthConfig reads the bandwidth limits (MB/s, 0 = unlimited) from environment variables
+// up is client -> backend, down is backend -> client
+// LB_RATE: per connection limit of both directions (default 100)
+// LB_RATE_UP, LB_RATE_DOWN: per connection limits, override LB_RATE for one direction
+// LB_CLIENT_RATE_UP, LB_CLIENT_RATE_DOWN: shared by all connections of a client IP (default unlimited)
+// LB_BACKEND_RATE_UP, LB_BACKEND_RATE_DOWN: shared by all connections to a backend (default unlimited)
+// LB_GLOBAL_RATE_UP, LB_GLOBAL_RATE_DOWN: shared by every connection of the balancer (default unlimited)
+func loadBandwidthConfig(env settings) (*BandwidthConfig, error) {
+	connectionRate, err := getEnvFloat(env, "LB_RATE", 100) // Default 100 MB/s
+	if err != nil {
+		return nil, err
+	}
+
+	bandwidth := &BandwidthConfig{}
+	rates := []struct {
+		key      string
+		value    *float64
+		fallback float64
+	}{
+		{"LB_RATE_UP", &bandwidth.ConnectionUp, connectionRate},
+		{"LB_RATE_DOWN", &bandwidth.ConnectionDown, connectionRate},
+		{"LB_CLIENT_RATE_UP", &bandwidth.ClientUp, 0},
+		{"LB_CLIENT_RATE_DOWN", &bandwidth.ClientDown, 0},
+		{"LB_BACKEND_RATE_UP", &bandwidth.BackendUp, 0},
+		{"LB_BACKEND_RATE_DOWN", &bandwidth.BackendDown, 0},
+		{"LB_GLOBAL_RATE_UP", &bandwidth.GlobalUp, 0},
+		{"LB_GLOBAL_RATE_DOWN", &bandwidth.GlobalDown, 0},
+	}
+	for _, rate := range rates {
+		if *rate.value, err = getEnvFloat(env, rate.key, rate.fallback); err != nil {
+			return nil, err
+		}
+	}
+	return bandwidth, nil
+}
+
+// loadTLSConfig reads the TLS settings from environment variables, nil when LB_TLS_MODE is not set
+// LB_TLS_MODE: terminate (decrypt with LB_TLS_CERT/LB_TLS_KEY) or passthrough (forward the encrypted stream)
+// LB_TLS_CERT, LB_TLS_KEY: pem files of the certificate and its key, required to terminate
+// LB_TLS_RELOAD_INTERVAL: how often the files are checked for a new certificate (default 10s)
+// LB_SNI_ROUTES: pools per server name like "users.internal=user-service-1:5000,user-service-2:5000;*.posts.internal=post-service:5000"
+// the connections without a matching server name go to LB_BACKENDS
+func loadTLSConfig(env settings) (*TLSConfig, error) {
+	mode := strings.ToLower(env("LB_TLS_MODE"))
+	routesStr := env("LB_SNI_ROUTES")
+	if mode == "" {
+		if routesStr != "" {
+			return nil, errors.New("LB_SNI_ROUTES needs LB_TLS_MODE to be set")
+		}
+		return nil, nil
+	}
+	if mode != TLSModeTerminate && mode != TLSModePassthrough {
+		return nil, errors.New("invalid LB_TLS_MODE: must be terminate or passthrough")
+	}
+
+	tlsConfig := &TLSConfig{
+		Mode:     mode,
+		CertFile: env("LB_TLS_CERT"),
+		KeyFile:  env("LB_TLS_KEY"),
+		Routes:   make(map[string][]BackendConfig),
+	}
+	if mode == TLSModeTerminate && (tlsConfig.CertFile == "" || tlsConfig.KeyFile == "") {
+		return nil, errors.New("LB_TLS_CERT and LB_TLS_KEY are required to terminate TLS")
+	}
+
+	var err error
+	if tlsConfig.ReloadInterval, err = getEnvDuration(env, "LB_TLS_RELOAD_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if tlsConfig.ReloadInterval == 0 {
+		return nil, errors.New("invalid LB_TLS_RELOAD_INTERVAL: must be positive")
+	}
+
+	for _, route := range strings.Split(routesStr, ";") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		serverName, backendsStr, ok := strings.Cut(route, "=")
+		if !ok || serverName == "" {
+			return nil, fmt.Errorf("invalid LB_SNI_ROUTES entry %q: must be name=backends", route)
+		}
+		backends, err := parseBackends(backendsStr)
 		if err != nil {
-			return nil, errors.New("invalid LB_RATE: must be a number")
+			return nil, fmt.Errorf("invalid backends of %s in LB_SNI_ROUTES: %w", serverName, err)
 		}
+		tlsConfig.Routes[strings.ToLower(serverName)] = backends
 	}
 
-	cfg := &Config{
-		Port:      port,
-		Algorithm: algorithm,
-		Backends:  backends,
-		Rate:      rate,
+	log.Printf("TLS: mode=%s routes=%v", tlsConfig.Mode, tlsConfig.Routes)
+	return tlsConfig, nil
+}
+
+// loadConnectionLimitConfig reads the limits on accepted connections from environment variables (0 = unlimited)
+// LB_MAX_CONNS_PER_IP: concurrent connections of a client IP
+// LB_CONN_RATE_PER_IP, LB_CONN_BURST_PER_IP: new connections per second of a client IP and the burst allowed
+// LB_MAX_CONNS: concurrent connections of the whole balancer
+// LB_ACCEPT_QUEUE, LB_ACCEPT_QUEUE_TIMEOUT: connections waiting for a slot once LB_MAX_CONNS is reached
+// and how long they wait (default 0 = reject immediately, 5s)
+func loadConnectionLimitConfig(env settings) (*ConnectionLimitConfig, error) {
+	var err error
+	limits := &ConnectionLimitConfig{}
+
+	if limits.MaxPerIP, err = getEnvInt(env, "LB_MAX_CONNS_PER_IP", 0); err != nil {
+		return nil, err
+	}
+	if limits.RatePerIP, err = getEnvFloat(env, "LB_CONN_RATE_PER_IP", 0); err != nil {
+		return nil, err
 	}
+	if limits.BurstPerIP, err = getEnvInt(env, "LB_CONN_BURST_PER_IP", max(1, int(limits.RatePerIP))); err != nil {
+		return nil, err
+	}
+	if limits.MaxConnections, err = getEnvInt(env, "LB_MAX_CONNS", 0); err != nil {
+		return nil, err
+	}
+	if limits.QueueSize, err = getEnvInt(env, "LB_ACCEPT_QUEUE", 0); err != nil {
+		return nil, err
+	}
+	if limits.QueueTimeout, err = getEnvDuration(env, "LB_ACCEPT_QUEUE_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if limits.RatePerIP > 0 && limits.BurstPerIP < 1 {
+		return nil, errors.New("invalid LB_CONN_BURST_PER_IP: must be at least 1")
+	}
+	return limits, nil
+}
 
-	return cfg, nil
+// loadAccessLogConfig reads the access log settings, nil when it is disabled
+// LB_ACCESS_LOG: stdout or the path of the file (default none)
+// LB_ACCESS_LOG_MAX_SIZE: size in MB after which the file is rotated (default 100)
+// LB_ACCESS_LOG_MAX_FILES: rotated files kept next to it (default 5)
+func loadAccessLogConfig(env settings) (*AccessLogConfig, error) {
+	output := env("LB_ACCESS_LOG")
+	if output == "" {
+		return nil, nil
+	}
+	maxSize, err := getEnvFloat(env, "LB_ACCESS_LOG_MAX_SIZE", 100)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize == 0 {
+		return nil, errors.New("invalid LB_ACCESS_LOG_MAX_SIZE: must be positive")
+	}
+	maxFiles, err := getEnvInt(env, "LB_ACCESS_LOG_MAX_FILES", 5)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogConfig{Output: output, MaxSize: int64(maxSize * 1024 * 1024), MaxFiles: maxFiles}, nil
+}
+
+// loadKeepAliveConfig reads the tcp keepalive settings of the client and backend connections
+// LB_TCP_KEEPALIVE: idle time before the first probe (default 15s, 0 disables the keepalive)
+// LB_TCP_KEEPALIVE_INTERVAL: time between two probes (default 15s)
+// LB_TCP_KEEPALIVE_COUNT: unanswered probes before the connection is dropped (default 9)
+func loadKeepAliveConfig(env settings) (net.KeepAliveConfig, error) {
+	var err error
+	keepAlive := net.KeepAliveConfig{}
+	if keepAlive.Idle, err = getEnvDuration(env, "LB_TCP_KEEPALIVE", 15*time.Second); err != nil {
+		return keepAlive, err
+	}
+	if keepAlive.Interval, err = getEnvDuration(env, "LB_TCP_KEEPALIVE_INTERVAL", 15*time.Second); err != nil {
+		return keepAlive, err
+	}
+	if keepAlive.Count, err = getEnvInt(env, "LB_TCP_KEEPALIVE_COUNT", 9); err != nil {
+		return keepAlive, err
+	}
+	if keepAlive.Interval <= 0 || keepAlive.Count < 1 {
+		return keepAlive, errors.New("LB_TCP_KEEPALIVE_INTERVAL must be positive and LB_TCP_KEEPALIVE_COUNT at least 1")
+	}
+	keepAlive.Enable = keepAlive.Idle > 0
+	return keepAlive, nil
+}
+
+// loadHealthCheckConfig reads the active health check settings from environment variables
+// LB_HEALTH_TYPE: tcp (default, only connect), http, udp (default in udp mode) or none (only the passive outlier detection)
+// LB_HEALTH_PATH: path of the http check (default /healthz)
+// LB_HEALTH_STATUS: accepted status codes of the http check (default 200-399)
+// LB_HEALTH_BODY: optional substring the http response body (or udp answer) has to contain
+// LB_HEALTH_SEND: datagram sent by the udp check, escapes like \x00 are allowed (default empty)
+// LB_HEALTH_INTERVAL, LB_HEALTH_TIMEOUT, LB_HEALTH_JITTER: durations like 10s (defaults 10s, 2s, 1s)
+// LB_HEALTH_RISE, LB_HEALTH_FALL: consecutive successes/failures needed to flip the state (defaults 2, 3)
+func loadHealthCheckConfig(env settings, mode string) (*HealthCheckConfig, error) {
+	healthCheck := &HealthCheckConfig{
+		Type:         strings.ToLower(env("LB_HEALTH_TYPE")),
+		Path:         env("LB_HEALTH_PATH"),
+		ExpectedBody: env("LB_HEALTH_BODY"),
+	}
+
+	switch healthCheck.Type {
+	case "":
+		// fall back to the plain tcp check when nothing is configured, a udp backend may not listen on tcp at all
+		healthCheck.Type = "tcp"
+		if mode == ListenerModeUDP {
+			healthCheck.Type = "udp"
+		}
+	case "tcp", "http", "udp", "none":
+	default:
+		return nil, errors.New("invalid LB_HEALTH_TYPE: must be tcp, http, udp or none")
+	}
+
+	if send := env("LB_HEALTH_SEND"); send != "" {
+		payload, err := strconv.Unquote(`"` + strings.ReplaceAll(send, `"`, `\"`) + `"`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LB_HEALTH_SEND: %w", err)
+		}
+		healthCheck.Send = []byte(payload)
+	}
+
+	if healthCheck.Path == "" {
+		healthCheck.Path = "/healthz"
+	}
+	if !strings.HasPrefix(healthCheck.Path, "/") {
+		healthCheck.Path = "/" + healthCheck.Path
+	}
+
+	statusStr := env("LB_HEALTH_STATUS")
+	if statusStr == "" {
+		statusStr = "200-399"
+	}
+	expectedStatus, err := parseStatusRanges(statusStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LB_HEALTH_STATUS: %w", err)
+	}
+	healthCheck.ExpectedStatus = expectedStatus
+
+	if healthCheck.Interval, err = getEnvDuration(env, "LB_HEALTH_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if healthCheck.Timeout, err = getEnvDuration(env, "LB_HEALTH_TIMEOUT", 2*time.Second); err != nil {
+		return nil, err
+	}
+	if healthCheck.Jitter, err = getEnvDuration(env, "LB_HEALTH_JITTER", time.Second); err != nil {
+		return nil, err
+	}
+	if healthCheck.Rise, err = getEnvInt(env, "LB_HEALTH_RISE", 2); err != nil {
+		return nil, err
+	}
+	if healthCheck.Fall, err = getEnvInt(env, "LB_HEALTH_FALL", 3); err != nil {
+		return nil, err
+	}
+	if healthCheck.Interval <= 0 || healthCheck.Timeout <= 0 {
+		return nil, errors.New("LB_HEALTH_INTERVAL and LB_HEALTH_TIMEOUT must be positive")
+	}
+	if healthCheck.Rise < 1 || healthCheck.Fall < 1 {
+		return nil, errors.New("LB_HEALTH_RISE and LB_HEALTH_FALL must be at least 1")
+	}
+
+	log.Printf("Health check: type=%s path=%s interval=%s timeout=%s rise=%d fall=%d",
+		healthCheck.Type, healthCheck.Path, healthCheck.Interval, healthCheck.Timeout, healthCheck.Rise, healthCheck.Fall)
+	return healthCheck, nil
+}
+
+// LB_BACKEND_HEALTH: health checks of single backends, overriding the one of the pool, as a json object by backend url
+// e.g. {"user-service-1:5000": {"type": "http", "path": "/ready", "status": "200", "body": "ok"}}
+// (in the config file it is an object: "backend_health": {"user-service-1:5000": {"path": "/ready"}})
+func loadBackendHealthChecks(env settings, backends []BackendConfig, healthCheck *HealthCheckConfig) error {
+	value := env("LB_BACKEND_HEALTH")
+	if value == "" {
+		return nil
+	}
+	var overrides map[string]*BackendHealthCheck
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&overrides); err != nil {
+		return fmt.Errorf("invalid LB_BACKEND_HEALTH: %w", err)
+	}
+	for url, override := range overrides {
+		index := slices.IndexFunc(backends, func(backend BackendConfig) bool { return backend.URL == url })
+		if index < 0 {
+			return fmt.Errorf("invalid LB_BACKEND_HEALTH: %s is not in LB_BACKENDS", url)
+		}
+		if _, err := override.apply(healthCheck); err != nil {
+			return fmt.Errorf("invalid LB_BACKEND_HEALTH of %s: %w", url, err)
+		}
+		backends[index].HealthCheck = override
+	}
+	return nil
+}
+
+// loadOutlierConfig reads the passive outlier detection settings from environment variables
+// LB_OUTLIER_FAILURES: consecutive failed connections before a backend is ejected (default 3, 0 disables it)
+// LB_OUTLIER_EJECTION, LB_OUTLIER_MAX_EJECTION: first and maximum ejection period (defaults 30s, 5m)
+// LB_OUTLIER_SHORT_SESSION: sessions shorter than this without any backend data count as failures (default 0, disabled)
+// LB_OUTLIER_MAX_EJECTION_PERCENT: share of the backends that can be ejected at the same time (default 100)
+func loadOutlierConfig(env settings) (*OutlierConfig, error) {
+	var err error
+	outlier := &OutlierConfig{}
+
+	if outlier.ConsecutiveFailures, err = getEnvInt(env, "LB_OUTLIER_FAILURES", 3); err != nil {
+		return nil, err
+	}
+	if outlier.BaseEjection, err = getEnvDuration(env, "LB_OUTLIER_EJECTION", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if outlier.MaxEjection, err = getEnvDuration(env, "LB_OUTLIER_MAX_EJECTION", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if outlier.ShortSession, err = getEnvDuration(env, "LB_OUTLIER_SHORT_SESSION", 0); err != nil {
+		return nil, err
+	}
+	if outlier.MaxEjectionPercent, err = getEnvInt(env, "LB_OUTLIER_MAX_EJECTION_PERCENT", 100); err != nil {
+		return nil, err
+	}
+	if outlier.MaxEjectionPercent < 1 || outlier.MaxEjectionPercent > 100 {
+		return nil, errors.New("invalid LB_OUTLIER_MAX_EJECTION_PERCENT: must be between 1 and 100")
+	}
+	if outlier.ConsecutiveFailures > 0 && (outlier.BaseEjection <= 0 || outlier.MaxEjection < outlier.BaseEjection) {
+		return nil, errors.New("LB_OUTLIER_EJECTION must be positive and not above LB_OUTLIER_MAX_EJECTION")
+	}
+	return outlier, nil
+}
+
+// Helper function to read a duration (e.g. 500ms, 10s) from an env var, or return the fallback if it is not set
+func getEnvDuration(env settings, key string, fallback time.Duration) (time.Duration, error) {
+	value := env(key)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s: must be a duration like 10s", key)
+	}
+	return duration, nil
+}
+
+// Helper function to read a positive number from an env var, or return the fallback if it is not set
+func getEnvFloat(env settings, key string, fallback float64) (float64, error) {
+	value := env(key)
+	if value == "" {
+		return fallback, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	// ParseFloat also takes NaN and Inf, neither is a usable rate or threshold
+	if err != nil || rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("invalid %s: must be a positive number", key)
+	}
+	return rate, nil
+}
+
+// Helper function to read an integer from an env var, or return the fallback if it is not set
+func getEnvInt(env settings, key string, fallback int) (int, error) {
+	value := env(key)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid %s: must be a positive integer", key)
+	}
+	return number, nil
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetEnvFloat(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: 7},
+		{value: "0.5", want: 0.5},
+		{value: "0", want: 0},
+		{value: "-1", wantErr: true},
+		{value: "fast", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "Inf", wantErr: true},
+		{value: "+Inf", wantErr: true},
+		{value: "-Inf", wantErr: true},
+	}
+	for _, test := range tests {
+		env := func(string) string { return test.value }
+		got, err := getEnvFloat(env, "LB_PRIORITY_THRESHOLD", 7)
+		if (err != nil) != test.wantErr || (err == nil && got != test.want) {
+			t.Errorf("getEnvFloat(%q) = %v, %v, want %v (error %v)", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []BackendConfig
+		wantErr bool
+	}{
+		{value: "user-1:5000", want: []BackendConfig{{URL: "user-1:5000", Weight: 1}}},
+		{value: " user-1:5000=3 , user-2:5000,", want: []BackendConfig{{URL: "user-1:5000", Weight: 3}, {URL: "user-2:5000", Weight: 1}}},
+		{value: "[::1]:5000=2", want: []BackendConfig{{URL: "[::1]:5000", Weight: 2}}},
+		{value: "[fe80::1%eth0]:5000", want: []BackendConfig{{URL: "[fe80::1%eth0]:5000", Weight: 1}}},
+		{value: "user-1:5000@1", want: []BackendConfig{{URL: "user-1:5000", Weight: 1, Priority: 1}}},
+		{value: "user-1:5000=3@2,user-2:5000@0", want: []BackendConfig{{URL: "user-1:5000", Weight: 3, Priority: 2}, {URL: "user-2:5000", Weight: 1}}},
+		{value: "[::1]:5000=2@1", want: []BackendConfig{{URL: "[::1]:5000", Weight: 2, Priority: 1}}},
+		{value: "", wantErr: true},
+		{value: " , ", wantErr: true},
+		{value: "user-1", wantErr: true},
+		{value: "::1:5000", wantErr: true},
+		{value: "user-1:5000=0", wantErr: true},
+		{value: "user-1:5000=-1", wantErr: true},
+		{value: "user-1:5000=heavy", wantErr: true},
+		{value: "user-1:5000=", wantErr: true},
+		{value: "user-1:5000,user-2", wantErr: true},
+		{value: "user-1:5000@", wantErr: true},
+		{value: "user-1:5000@-1", wantErr: true},
+		{value: "user-1:5000@backup", wantErr: true},
+		{value: "user-1:5000@1=3", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseBackends(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseBackends(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBackends(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}